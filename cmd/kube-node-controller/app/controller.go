@@ -0,0 +1,495 @@
+package app
+
+/*
+   app implements the kube-node-controller
+
+   The controller watches K8s node objects and allocates a subnet per
+   node for each configured network from cluster-wide pools. The
+   subnets are written to the annotation read by kube-node, and are
+   released when the node is deleted.
+
+   Allocations are stored in a ConfigMap before the node annotation is
+   written, so a restart never hands out a duplicate subnet. On start,
+   subnets in existing annotations are claimed before any allocation,
+   in case the ConfigMap is lost or stale.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/Nordix/ipam-node-annotation/pkg/subnetpool"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Config The controller configuration
+type Config struct {
+	Namespace string          `json:"namespace,omitempty"`
+	ConfigMap string          `json:"configMap,omitempty"`
+	Networks  []NetworkConfig `json:"networks"`
+}
+
+// NetworkConfig A network with an annotation and one pool per family
+type NetworkConfig struct {
+	Name       string       `json:"name"`
+	Annotation string       `json:"annotation"`
+	Pools      []PoolConfig `json:"pools"`
+}
+
+// PoolConfig A cluster-wide pool and the prefix length of node subnets
+type PoolConfig struct {
+	CIDR   string `json:"cidr"`
+	Prefix int    `json:"prefix"`
+}
+
+// ReadConfig Reads a json config file
+func ReadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// network Holds the pools and allocations for a network
+type network struct {
+	cfg   NetworkConfig
+	pools []*subnetpool.Pool
+	nodes map[string][]string // node name -> subnets
+}
+
+// allocation A node entry added to a network, used for rollback
+type allocation struct {
+	n    *network
+	node string
+}
+
+// Controller Allocates node subnets
+type Controller struct {
+	logger   logr.Logger
+	client   kubernetes.Interface
+	cfg      *Config
+	networks []*network
+	mu       sync.Mutex
+}
+
+// New Creates a controller and loads stored allocations
+func New(
+	ctx context.Context, client kubernetes.Interface, cfg *Config) (*Controller, error) {
+	c := Controller{
+		logger: logr.FromContextOrDiscard(ctx),
+		client: client,
+		cfg:    cfg,
+	}
+	if c.cfg.Namespace == "" {
+		c.cfg.Namespace = "kube-system"
+	}
+	if c.cfg.ConfigMap == "" {
+		c.cfg.ConfigMap = "kube-node-controller"
+	}
+	if len(cfg.Networks) == 0 {
+		return nil, fmt.Errorf("No networks")
+	}
+	for _, ncfg := range cfg.Networks {
+		n, err := newNetwork(ncfg)
+		if err != nil {
+			return nil, fmt.Errorf("Network %s: %v", ncfg.Name, err)
+		}
+		c.networks = append(c.networks, n)
+	}
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func newNetwork(cfg NetworkConfig) (*network, error) {
+	if cfg.Name == "" || cfg.Annotation == "" {
+		return nil, fmt.Errorf("Name and annotation must be specified")
+	}
+	if len(cfg.Pools) == 0 || len(cfg.Pools) > 2 {
+		return nil, fmt.Errorf("One or two pools must be specified")
+	}
+	n := network{cfg: cfg, nodes: make(map[string][]string)}
+	for _, pcfg := range cfg.Pools {
+		p, err := subnetpool.New(pcfg.CIDR, pcfg.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		n.pools = append(n.pools, p)
+	}
+	if len(n.pools) == 2 && n.pools[0].IsIPv4() == n.pools[1].IsIPv4() {
+		return nil, fmt.Errorf("Pools of same family")
+	}
+	return &n, nil
+}
+
+// claim Marks the subnets as used in the pools. On failure nothing
+// is claimed
+func (n *network) claim(subnets []string) error {
+	var claimed []string
+	for _, s := range subnets {
+		var err error = fmt.Errorf("Subnet %s not in any pool", s)
+		for _, p := range n.pools {
+			if p.Contains(s) {
+				err = p.Claim(s)
+				break
+			}
+		}
+		if err != nil {
+			n.release(claimed)
+			return err
+		}
+		claimed = append(claimed, s)
+	}
+	return nil
+}
+
+// claimStored Claims stored subnets. Unlike claim, every subnet in a
+// pool is kept claimed when others fail, so it can't be allocated to
+// another node. The errors are joined
+func (n *network) claimStored(subnets []string) error {
+	var errs []error
+	for _, s := range subnets {
+		var err error = fmt.Errorf("Subnet %s not in any pool", s)
+		for _, p := range n.pools {
+			if p.Contains(s) {
+				err = p.Claim(s)
+				break
+			}
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// allocate Allocates one subnet from each pool
+func (n *network) allocate() ([]string, error) {
+	var subnets []string
+	for _, p := range n.pools {
+		s, err := p.Allocate()
+		if err != nil {
+			n.release(subnets)
+			return nil, err
+		}
+		subnets = append(subnets, s)
+	}
+	return subnets, nil
+}
+
+func (n *network) release(subnets []string) {
+	for _, s := range subnets {
+		for _, p := range n.pools {
+			p.Release(s)
+		}
+	}
+}
+
+// load Reads stored allocations from the ConfigMap
+func (c *Controller) load(ctx context.Context) error {
+	cm, err := c.client.CoreV1().ConfigMaps(c.cfg.Namespace).Get(
+		ctx, c.cfg.ConfigMap, meta.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	for _, n := range c.networks {
+		data, ok := cm.Data[n.cfg.Name]
+		if !ok {
+			continue
+		}
+		var nodes map[string][]string
+		if err := json.Unmarshal([]byte(data), &nodes); err != nil {
+			return fmt.Errorf("Stored allocations for %s: %v", n.cfg.Name, err)
+		}
+		for node, subnets := range nodes {
+			if err := n.claimStored(subnets); err != nil {
+				// The pool config may have changed. Keep the
+				// allocation to avoid duplicates
+				c.logger.Error(err, "Claim stored", "network", n.cfg.Name, "node", node)
+			}
+			n.nodes[node] = subnets
+		}
+	}
+	return nil
+}
+
+// store Writes all allocations to the ConfigMap
+func (c *Controller) store(ctx context.Context) error {
+	data := make(map[string]string)
+	for _, n := range c.networks {
+		s, err := json.Marshal(n.nodes)
+		if err != nil {
+			return err
+		}
+		data[n.cfg.Name] = string(s)
+	}
+	api := c.client.CoreV1().ConfigMaps(c.cfg.Namespace)
+	cm, err := api.Get(ctx, c.cfg.ConfigMap, meta.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		cm = &k8s.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      c.cfg.ConfigMap,
+				Namespace: c.cfg.Namespace,
+			},
+			Data: data,
+		}
+		_, err = api.Create(ctx, cm, meta.CreateOptions{})
+		return err
+	}
+	cm.Data = data
+	_, err = api.Update(ctx, cm, meta.UpdateOptions{})
+	return err
+}
+
+// SyncNode Makes sure the node has a subnet for each network
+func (c *Controller) SyncNode(ctx context.Context, node *k8s.Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	annotations := make(map[string]string)
+	var added []allocation
+	var allocErr error
+	for _, n := range c.networks {
+		key := n.cfg.Annotation
+		current := node.ObjectMeta.Annotations[key]
+		if subnets, ok := n.nodes[node.Name]; ok {
+			if value := strings.Join(subnets, ","); value != current {
+				annotations[key] = value
+			}
+			continue
+		}
+
+		var subnets []string
+		if current != "" {
+			// Adopt an existing annotation if it's inside the pools
+			cidrs, err := rangesource.ParseCIDRs(current)
+			if err == nil {
+				err = n.claim(cidrs)
+			}
+			if err != nil {
+				c.logger.Error(
+					err, "Existing annotation not adopted",
+					"node", node.Name, "annotation", key, "value", current)
+				continue
+			}
+			subnets = cidrs
+		} else {
+			var err error
+			if subnets, err = n.allocate(); err != nil {
+				allocErr = fmt.Errorf("Network %s: %v", n.cfg.Name, err)
+				continue
+			}
+			annotations[key] = strings.Join(subnets, ",")
+		}
+		n.nodes[node.Name] = subnets
+		added = append(added, allocation{n: n, node: node.Name})
+		c.logger.Info("Allocated", "node", node.Name, "network", n.cfg.Name, "subnets", subnets)
+	}
+
+	if len(added) > 0 {
+		// Store before annotating the node to prevent duplicates on restart
+		if err := c.store(ctx); err != nil {
+			c.rollback(added)
+			return err
+		}
+	}
+	if len(annotations) > 0 {
+		if err := c.annotate(ctx, node.Name, annotations); err != nil {
+			return err
+		}
+	}
+	return allocErr
+}
+
+// ClaimExisting Claims the subnets in the annotations of the nodes,
+// so they are not allocated for other nodes. Must be called before
+// any SyncNode, since the stored allocations may be lost or stale.
+// Annotations outside the pools, or conflicting with stored
+// allocations, are logged and ignored
+func (c *Controller) ClaimExisting(ctx context.Context, nodes []*k8s.Node) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var added []allocation
+	for _, n := range c.networks {
+		for _, node := range nodes {
+			current := node.ObjectMeta.Annotations[n.cfg.Annotation]
+			if _, ok := n.nodes[node.Name]; ok || current == "" {
+				continue
+			}
+			cidrs, err := rangesource.ParseCIDRs(current)
+			if err == nil {
+				err = n.claim(cidrs)
+			}
+			if err != nil {
+				c.logger.Error(
+					err, "Existing annotation not claimed", "node", node.Name,
+					"annotation", n.cfg.Annotation, "value", current)
+				continue
+			}
+			n.nodes[node.Name] = cidrs
+			added = append(added, allocation{n: n, node: node.Name})
+			c.logger.Info("Claimed", "node", node.Name, "network", n.cfg.Name, "subnets", cidrs)
+		}
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	if err := c.store(ctx); err != nil {
+		c.rollback(added)
+		return err
+	}
+	return nil
+}
+
+// rollback Releases allocations that could not be stored
+func (c *Controller) rollback(added []allocation) {
+	for _, a := range added {
+		a.n.release(a.n.nodes[a.node])
+		delete(a.n.nodes, a.node)
+	}
+}
+
+// DeleteNode Releases all subnets allocated for the node
+func (c *Controller) DeleteNode(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changed := false
+	for _, n := range c.networks {
+		if subnets, ok := n.nodes[name]; ok {
+			n.release(subnets)
+			delete(n.nodes, name)
+			changed = true
+			c.logger.Info("Released", "node", name, "network", n.cfg.Name, "subnets", subnets)
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return c.store(ctx)
+}
+
+// Allocated Returns the subnets allocated for a node in a network
+func (c *Controller) Allocated(network, node string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.networks {
+		if n.cfg.Name == network {
+			return n.nodes[node]
+		}
+	}
+	return nil
+}
+
+func (c *Controller) annotate(
+	ctx context.Context, name string, annotations map[string]string) error {
+	patch := map[string]any{
+		"metadata": map[string]any{"annotations": annotations},
+	}
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = c.client.CoreV1().Nodes().Patch(
+		ctx, name, types.MergePatchType, data, meta.PatchOptions{})
+	return err
+}
+
+// Run Watches nodes until the context is cancelled. The event handler
+// is added after existing annotations are claimed, and then gets an
+// add event for each node
+func (c *Controller) Run(ctx context.Context) error {
+	factory := informers.NewSharedInformerFactory(c.client, 0)
+	informer := factory.Core().V1().Nodes().Informer()
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("Node cache not synced")
+	}
+	lister := factory.Core().V1().Nodes().Lister()
+	nodes, err := lister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	if err := c.ClaimExisting(ctx, nodes); err != nil {
+		return err
+	}
+
+	// Release subnets for nodes deleted while we were not running
+	for _, name := range c.allocatedNodes() {
+		if _, err := lister.Get(name); errors.IsNotFound(err) {
+			if err := c.DeleteNode(ctx, name); err != nil {
+				c.logger.Error(err, "DeleteNode", "node", name)
+			}
+		}
+	}
+
+	_, err = informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			c.onNode(ctx, obj)
+		},
+		UpdateFunc: func(_, obj any) {
+			c.onNode(ctx, obj)
+		},
+		DeleteFunc: func(obj any) {
+			if d, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = d.Obj
+			}
+			if node, ok := obj.(*k8s.Node); ok {
+				if err := c.DeleteNode(ctx, node.Name); err != nil {
+					c.logger.Error(err, "DeleteNode", "node", node.Name)
+				}
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	<-ctx.Done()
+	factory.Shutdown()
+	return nil
+}
+
+func (c *Controller) onNode(ctx context.Context, obj any) {
+	if node, ok := obj.(*k8s.Node); ok {
+		if err := c.SyncNode(ctx, node); err != nil {
+			c.logger.Error(err, "SyncNode", "node", node.Name)
+		}
+	}
+}
+
+func (c *Controller) allocatedNodes() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for _, n := range c.networks {
+		for name := range n.nodes {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,291 @@
+package app
+
+// go test -test.v
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testAnnotation = "kube-node.nordix.org/net1"
+
+func testConfig() *Config {
+	return &Config{
+		Networks: []NetworkConfig{
+			{
+				Name:       "net1",
+				Annotation: testAnnotation,
+				Pools: []PoolConfig{
+					{CIDR: "172.20.0.0/22", Prefix: 24},
+					{CIDR: "fd00::/64", Prefix: 96},
+				},
+			},
+		},
+	}
+}
+
+func testNode(name string, annotations map[string]string) *k8s.Node {
+	return &k8s.Node{
+		ObjectMeta: meta.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+// syncNode Reads the node from the API and syncs it
+func syncNode(t *testing.T, c *Controller, client kubernetes.Interface, name string) string {
+	ctx := context.TODO()
+	n, err := client.CoreV1().Nodes().Get(ctx, name, meta.GetOptions{})
+	if err != nil {
+		t.Fatal("Get node:", err)
+	}
+	if err := c.SyncNode(ctx, n); err != nil {
+		t.Fatal("SyncNode:", err)
+	}
+	n, _ = client.CoreV1().Nodes().Get(ctx, name, meta.GetOptions{})
+	return n.ObjectMeta.Annotations[testAnnotation]
+}
+
+func TestConfigValidation(t *testing.T) {
+	tcases := []struct {
+		name        string
+		networks    []NetworkConfig
+		expectError bool
+	}{
+		{
+			name:     "OK",
+			networks: testConfig().Networks,
+		},
+		{
+			name:        "No networks",
+			expectError: true,
+		},
+		{
+			name: "No annotation",
+			networks: []NetworkConfig{
+				{Name: "net1", Pools: []PoolConfig{{CIDR: "10.0.0.0/16", Prefix: 24}}},
+			},
+			expectError: true,
+		},
+		{
+			name: "Same family",
+			networks: []NetworkConfig{
+				{
+					Name: "net1", Annotation: testAnnotation,
+					Pools: []PoolConfig{
+						{CIDR: "10.0.0.0/16", Prefix: 24},
+						{CIDR: "10.1.0.0/16", Prefix: 24},
+					},
+				},
+			},
+			expectError: true,
+		},
+		{
+			name: "Invalid prefix",
+			networks: []NetworkConfig{
+				{
+					Name: "net1", Annotation: testAnnotation,
+					Pools: []PoolConfig{{CIDR: "10.0.0.0/16", Prefix: 8}},
+				},
+			},
+			expectError: true,
+		},
+	}
+	for _, tc := range tcases {
+		_, err := New(
+			context.TODO(), fake.NewSimpleClientset(), &Config{Networks: tc.networks})
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+	}
+}
+
+func TestAllocation(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(
+		testNode("vm-002", nil),
+		testNode("vm-003", nil),
+		testNode("vm-004", map[string]string{
+			testAnnotation: "172.20.3.0/24,fd00::3:0:0/96",
+		}),
+		testNode("vm-005", map[string]string{
+			testAnnotation: "192.168.0.0/24",
+		}),
+	)
+	c, err := New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+
+	tcases := []struct {
+		node   string
+		expect string
+	}{
+		{node: "vm-002", expect: "172.20.0.0/24,fd00::/96"},
+		{node: "vm-003", expect: "172.20.1.0/24,fd00::1:0:0/96"},
+		{node: "vm-004", expect: "172.20.3.0/24,fd00::3:0:0/96"}, // Adopted
+		{node: "vm-005", expect: "192.168.0.0/24"},               // Not managed
+		{node: "vm-002", expect: "172.20.0.0/24,fd00::/96"},      // No change
+	}
+	for _, tc := range tcases {
+		if a := syncNode(t, c, client, tc.node); a != tc.expect {
+			t.Fatalf("%s: expected %s, got %s", tc.node, tc.expect, a)
+		}
+	}
+	if a := c.Allocated("net1", "vm-005"); a != nil {
+		t.Fatalf("vm-005: unexpected allocation %v", a)
+	}
+
+	// Restart. Stored allocations must not be handed out again
+	_ = client.CoreV1().Nodes().Delete(ctx, "vm-003", meta.DeleteOptions{})
+	_, _ = client.CoreV1().Nodes().Create(ctx, testNode("vm-006", nil), meta.CreateOptions{})
+	c, err = New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New after restart:", err)
+	}
+	if a := syncNode(t, c, client, "vm-006"); a != "172.20.2.0/24,fd00::2:0:0/96" {
+		t.Fatalf("vm-006: got %s", a)
+	}
+
+	// Pool exhausted
+	_, _ = client.CoreV1().Nodes().Create(ctx, testNode("vm-007", nil), meta.CreateOptions{})
+	n, _ := client.CoreV1().Nodes().Get(ctx, "vm-007", meta.GetOptions{})
+	if err := c.SyncNode(ctx, n); err == nil {
+		t.Fatal("vm-007: expected pool exhausted")
+	}
+
+	// Release the subnets of the deleted node
+	if err := c.DeleteNode(ctx, "vm-003"); err != nil {
+		t.Fatal("DeleteNode:", err)
+	}
+	if a := syncNode(t, c, client, "vm-007"); a != "172.20.1.0/24,fd00::1:0:0/96" {
+		t.Fatalf("vm-007: got %s", a)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := fake.NewSimpleClientset(testNode("vm-002", nil))
+	c, err := New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	go func() {
+		_ = c.Run(ctx)
+	}()
+
+	for ctx.Err() == nil {
+		n, _ := client.CoreV1().Nodes().Get(ctx, "vm-002", meta.GetOptions{})
+		if n.ObjectMeta.Annotations[testAnnotation] != "" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	_ = client.CoreV1().Nodes().Delete(ctx, "vm-002", meta.DeleteOptions{})
+	for ctx.Err() == nil {
+		if c.Allocated("net1", "vm-002") == nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatal("Timeout")
+}
+
+func TestStoreFailure(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(testNode("vm-002", nil))
+	c, err := New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	fail := true
+	client.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if fail && action.GetVerb() != "get" {
+			return true, nil, fmt.Errorf("Injected failure")
+		}
+		return false, nil, nil
+	})
+	n, _ := client.CoreV1().Nodes().Get(ctx, "vm-002", meta.GetOptions{})
+	if err := c.SyncNode(ctx, n); err == nil {
+		t.Fatal("Expected store failure")
+	}
+	if a := c.Allocated("net1", "vm-002"); a != nil {
+		t.Fatalf("Allocation kept after store failure: %v", a)
+	}
+	n, _ = client.CoreV1().Nodes().Get(ctx, "vm-002", meta.GetOptions{})
+	if a := n.ObjectMeta.Annotations[testAnnotation]; a != "" {
+		t.Fatalf("Annotated without store: %s", a)
+	}
+	// The subnets are released
+	fail = false
+	if a := syncNode(t, c, client, "vm-002"); a != "172.20.0.0/24,fd00::/96" {
+		t.Fatalf("vm-002: got %s", a)
+	}
+}
+
+func TestClaimExisting(t *testing.T) {
+	ctx := context.TODO()
+	// The ConfigMap is lost, vm-002 is annotated but not synced
+	nodes := []*k8s.Node{
+		testNode("vm-002", map[string]string{testAnnotation: "172.20.0.0/24,fd00::/96"}),
+		testNode("vm-003", nil),
+		testNode("vm-004", map[string]string{testAnnotation: "192.168.0.0/24"}),
+	}
+	client := fake.NewSimpleClientset(nodes[0], nodes[1], nodes[2])
+	c, err := New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	if err := c.ClaimExisting(ctx, nodes); err != nil {
+		t.Fatal("ClaimExisting:", err)
+	}
+	if a := syncNode(t, c, client, "vm-003"); a != "172.20.1.0/24,fd00::1:0:0/96" {
+		t.Fatalf("vm-003: got %s", a)
+	}
+	// Stored
+	c, err = New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New after restart:", err)
+	}
+	if a := c.Allocated("net1", "vm-002"); len(a) != 2 {
+		t.Fatalf("vm-002: not stored, %v", a)
+	}
+	if a := c.Allocated("net1", "vm-004"); a != nil {
+		t.Fatalf("vm-004: unexpected allocation %v", a)
+	}
+}
+
+func TestLoadOutOfPool(t *testing.T) {
+	ctx := context.TODO()
+	// The pool config changed, one stored subnet is no longer in a pool
+	cm := &k8s.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{Name: "kube-node-controller", Namespace: "kube-system"},
+		Data:       map[string]string{"net1": `{"vm-001":["172.20.0.0/24","fd01::/96"]}`},
+	}
+	client := fake.NewSimpleClientset(cm, testNode("vm-002", nil))
+	c, err := New(ctx, client, testConfig())
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	if a := c.Allocated("net1", "vm-001"); len(a) != 2 {
+		t.Fatalf("vm-001: not loaded, %v", a)
+	}
+	// The in-pool subnet is still claimed
+	if a := syncNode(t, c, client, "vm-002"); a != "172.20.1.0/24,fd00::/96" {
+		t.Fatalf("vm-002: got %s", a)
+	}
+}
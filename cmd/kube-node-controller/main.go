@@ -0,0 +1,66 @@
+package main
+
+/*
+   Kube-node-controller allocates a subnet per K8s node for secondary
+   networks and writes it to the annotation read by kube-node. This
+   replaces manual "kubectl annotate node ..." for every node and
+   network.
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Nordix/ipam-node-annotation/cmd/kube-node-controller/app"
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+)
+
+var (
+	version string = "unknown"
+)
+
+func main() {
+	flagVersion := flag.Bool("version", false, "Print version")
+	config := flag.String(
+		"config", "/etc/kube-node-controller/config.json", "Config file")
+	loglevel := flag.String("loglevel", "info", "Log level")
+	flag.Parse()
+	if *flagVersion {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	ctx, cancel := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	zlogger, err := log.ZapLogger("stderr", *loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctx = log.NewContext(ctx, zlogger)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("Started", "version", version, "config", *config)
+
+	cfg, err := app.ReadConfig(*config)
+	if err != nil {
+		log.Fatal(ctx, "Read config", "error", err)
+	}
+	clientset, err := util.GetClientset()
+	if err != nil {
+		log.Fatal(ctx, "Get clientset", "error", err)
+	}
+	c, err := app.New(ctx, clientset, cfg)
+	if err != nil {
+		log.Fatal(ctx, "Create controller", "error", err)
+	}
+	if err := c.Run(ctx); err != nil {
+		log.Fatal(ctx, "Run", "error", err)
+	}
+}
@@ -0,0 +1,329 @@
+package app
+
+/*
+   app implements the kube-node-webhook
+
+   The webhook validates updates of K8s node objects that touch the
+   configured kube-node annotations. The annotation values are parsed
+   and validated in the same way as in kube-node, so malformed
+   annotations are rejected instead of failing on POD creation.
+   Optionally subnets that overlap the service CIDRs, a subnet in
+   another annotation or spec.podCIDRs on the same node, or any of
+   them on another node, are rejected.
+
+   The webhook can also mutate PODs. A limit for an extended resource,
+   e.g. free IPv4 addresses published by "kube-node agent", is
+   injected in PODs created in the configured namespaces.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/go-logr/logr"
+	admission "k8s.io/api/admission/v1"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Config The webhook configuration
+type Config struct {
+	Annotations   []string `json:"annotations"`
+	RejectOverlap bool     `json:"rejectOverlap,omitempty"`
+	ServiceCIDRs  []string `json:"serviceCIDRs,omitempty"`
+	// Resources Injected in PODs
+	Resources []Resource `json:"resources,omitempty"`
+}
+
+// Resource An extended resource injected with a limit of 1 in the
+// first container of PODs created in the namespaces, unless a
+// container already has it
+type Resource struct {
+	Name       string   `json:"name"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// ReadConfig Reads a json config file
+func ReadConfig(file string) (*Config, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Webhook Validates kube-node annotations on node objects
+type Webhook struct {
+	logger logr.Logger
+	client kubernetes.Interface
+	cfg    *Config
+}
+
+// New Creates a webhook. The client is used to read other nodes when
+// overlaps are checked
+func New(
+	ctx context.Context, client kubernetes.Interface, cfg *Config) (*Webhook, error) {
+	if len(cfg.Annotations) == 0 && len(cfg.Resources) == 0 {
+		return nil, fmt.Errorf("No annotations or resources")
+	}
+	for _, r := range cfg.Resources {
+		if errs := validation.IsQualifiedName(r.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("Resource %s: %v", r.Name, errs)
+		}
+	}
+	for _, cidr := range cfg.ServiceCIDRs {
+		if _, err := rangesource.ParseCIDRs(cidr); err != nil {
+			return nil, fmt.Errorf("Service CIDR: %v", err)
+		}
+	}
+	return &Webhook{
+		logger: logr.FromContextOrDiscard(ctx),
+		client: client,
+		cfg:    cfg,
+	}, nil
+}
+
+// ServeHTTP Handles an AdmissionReview request. Nodes are validated
+// and PODs are mutated
+func (w *Webhook) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var review admission.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(rw, "No request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = &admission.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	var err error
+	if review.Request.Kind.Kind == "Pod" {
+		var patch []byte
+		if patch, err = w.mutate(review.Request); patch != nil {
+			pt := admission.PatchTypeJSONPatch
+			review.Response.Patch = patch
+			review.Response.PatchType = &pt
+		}
+	} else {
+		err = w.validate(r.Context(), review.Request)
+	}
+	if err != nil {
+		w.logger.Info("Rejected", "kind", review.Request.Kind.Kind,
+			"name", review.Request.Name, "reason", err.Error())
+		review.Response.Allowed = false
+		review.Response.Result = &meta.Status{
+			Status:  meta.StatusFailure,
+			Message: err.Error(),
+			Reason:  meta.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+	}
+	review.Request = nil
+
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(&review); err != nil {
+		w.logger.Error(err, "Encode response")
+	}
+}
+
+// validate Validates the annotations in a node admission request
+func (w *Webhook) validate(
+	ctx context.Context, req *admission.AdmissionRequest) error {
+	if req.Kind.Kind != "Node" {
+		return nil
+	}
+	var node, old k8s.Node
+	if err := json.Unmarshal(req.Object.Raw, &node); err != nil {
+		return fmt.Errorf("Decode node: %v", err)
+	}
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, &old); err != nil {
+			return fmt.Errorf("Decode old node: %v", err)
+		}
+	}
+
+	var nodes []k8s.Node // Read when needed
+	for _, key := range w.cfg.Annotations {
+		value, ok := node.ObjectMeta.Annotations[key]
+		if !ok || value == old.ObjectMeta.Annotations[key] {
+			continue // Not touched, or removed
+		}
+		cidrs, err := rangesource.ParseCIDRs(value)
+		if err == nil {
+			err = rangesource.Validate(cidrs)
+		}
+		if err != nil {
+			return fmt.Errorf("Annotation %s: %v", key, err)
+		}
+		if !w.cfg.RejectOverlap {
+			continue
+		}
+
+		for _, cidr := range cidrs {
+			for _, svc := range w.cfg.ServiceCIDRs {
+				if rangesource.Overlap(cidr, svc) {
+					return fmt.Errorf(
+						"Annotation %s: %s overlaps service CIDR %s", key, cidr, svc)
+				}
+			}
+		}
+		if nodes == nil {
+			list, err := w.client.CoreV1().Nodes().List(ctx, meta.ListOptions{})
+			if err != nil {
+				return fmt.Errorf("List nodes: %v", err)
+			}
+			nodes = list.Items
+		}
+		err = checkNodeOverlap(nodes, &node, key, cidrs, w.cfg.Annotations)
+		if err != nil {
+			return fmt.Errorf("Annotation %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// mutate Returns a json patch that injects the configured resources
+// in a created POD, or nil
+func (w *Webhook) mutate(req *admission.AdmissionRequest) ([]byte, error) {
+	if req.Operation != admission.Create || len(w.cfg.Resources) == 0 {
+		return nil, nil
+	}
+	var pod k8s.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return nil, fmt.Errorf("Decode pod: %v", err)
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return nil, nil
+	}
+	ns := req.Namespace
+	if ns == "" {
+		ns = pod.Namespace
+	}
+	res := pod.Spec.Containers[0].Resources.DeepCopy()
+	injected := false
+	for _, r := range w.cfg.Resources {
+		if !contains(r.Namespaces, ns) || hasResource(&pod, r.Name) {
+			continue
+		}
+		if res.Limits == nil {
+			res.Limits = make(k8s.ResourceList)
+		}
+		res.Limits[k8s.ResourceName(r.Name)] = resource.MustParse("1")
+		injected = true
+	}
+	if !injected {
+		return nil, nil
+	}
+	w.logger.V(1).Info("Inject resources", "podNamespace", ns, "limits", res.Limits)
+	// "add" replaces an existing value
+	return json.Marshal([]map[string]any{{
+		"op":    "add",
+		"path":  "/spec/containers/0/resources",
+		"value": res,
+	}})
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// hasResource Returns true if any container has a limit or request
+// for the resource
+func hasResource(pod *k8s.Pod, name string) bool {
+	for _, c := range pod.Spec.Containers {
+		if _, ok := c.Resources.Limits[k8s.ResourceName(name)]; ok {
+			return true
+		}
+		if _, ok := c.Resources.Requests[k8s.ResourceName(name)]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// nodeSubnets Subnets on a node from one source, an annotation key
+// or "spec.podCIDRs"
+type nodeSubnets struct {
+	source string
+	cidrs  []string
+}
+
+// subnetsOf Returns the subnets in the annotations and spec.podCIDRs
+// of a node. Unparsable values are skipped
+func subnetsOf(n *k8s.Node, keys []string) []nodeSubnets {
+	var subnets []nodeSubnets
+	for _, key := range keys {
+		value, ok := n.ObjectMeta.Annotations[key]
+		if !ok {
+			continue
+		}
+		cidrs, err := rangesource.ParseCIDRs(value)
+		if err != nil {
+			continue // Pre-existing garbage
+		}
+		subnets = append(subnets, nodeSubnets{source: key, cidrs: cidrs})
+	}
+	podCIDRs := n.Spec.PodCIDRs
+	if len(podCIDRs) == 0 && n.Spec.PodCIDR != "" {
+		podCIDRs = []string{n.Spec.PodCIDR}
+	}
+	if len(podCIDRs) > 0 {
+		subnets = append(subnets, nodeSubnets{source: "spec.podCIDRs", cidrs: podCIDRs})
+	}
+	return subnets
+}
+
+// checkNodeOverlap Returns an error if any cidr in the annotation key
+// overlaps a subnet in another of the annotation keys or in
+// spec.podCIDRs on the node, or in any of them on another node
+func checkNodeOverlap(
+	nodes []k8s.Node, node *k8s.Node, key string, cidrs, keys []string) error {
+	check := func(n *k8s.Node) error {
+		for _, s := range subnetsOf(n, keys) {
+			if n.Name == node.Name && s.source == key {
+				continue
+			}
+			for _, a := range cidrs {
+				for _, b := range s.cidrs {
+					if rangesource.Overlap(a, b) {
+						return fmt.Errorf(
+							"%s overlaps %s in %s on node %s", a, b, s.source, n.Name)
+					}
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(node); err != nil {
+		return err
+	}
+	for i := range nodes {
+		if nodes[i].Name == node.Name {
+			continue // The updated object is checked
+		}
+		if err := check(&nodes[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
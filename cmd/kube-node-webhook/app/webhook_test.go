@@ -0,0 +1,272 @@
+package app
+
+// go test -test.v
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admission "k8s.io/api/admission/v1"
+	k8s "k8s.io/api/core/v1"
+	apiresource "k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testAnnotation = "kube-node.nordix.org/net1"
+
+func testNode(name, value string) *k8s.Node {
+	n := &k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: name},
+	}
+	if value != "" {
+		n.ObjectMeta.Annotations = map[string]string{testAnnotation: value}
+	}
+	return n
+}
+
+func review(t *testing.T, url string, node, old *k8s.Node) *admission.AdmissionResponse {
+	raw := func(n *k8s.Node) runtime.RawExtension {
+		if n == nil {
+			return runtime.RawExtension{}
+		}
+		data, err := json.Marshal(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: data}
+	}
+	return post(t, url, &admission.AdmissionRequest{
+		UID:       "4711",
+		Kind:      meta.GroupVersionKind{Version: "v1", Kind: "Node"},
+		Name:      node.Name,
+		Operation: admission.Update,
+		Object:    raw(node),
+		OldObject: raw(old),
+	})
+}
+
+func post(t *testing.T, url string, r *admission.AdmissionRequest) *admission.AdmissionResponse {
+	req := admission.AdmissionReview{
+		TypeMeta: meta.TypeMeta{
+			APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: r,
+	}
+	data, _ := json.Marshal(&req)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal("Post:", err)
+	}
+	defer resp.Body.Close()
+	var res admission.AdmissionReview
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		t.Fatal("Decode:", err)
+	}
+	if res.Response == nil || res.Response.UID != "4711" {
+		t.Fatal("Invalid response", res.Response)
+	}
+	return res.Response
+}
+
+func TestWebhook(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		testNode("vm-002", "172.20.2.0/24,fd00::2:0:0/96"),
+		testNode("vm-003", "blah"),
+	)
+	cfg := &Config{
+		Annotations:   []string{testAnnotation},
+		RejectOverlap: true,
+		ServiceCIDRs:  []string{"10.96.0.0/12", "fd00:4000::/112"},
+	}
+	w, err := New(context.TODO(), client, cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	srv := httptest.NewServer(w)
+	defer srv.Close()
+
+	tcases := []struct {
+		name   string
+		node   *k8s.Node
+		old    *k8s.Node
+		reject bool
+	}{
+		{
+			name: "OK",
+			node: testNode("vm-004", "172.20.4.0/24,fd00::4:0:0/96"),
+		},
+		{
+			name: "No annotation",
+			node: testNode("vm-004", ""),
+		},
+		{
+			name: "Unchanged invalid",
+			node: testNode("vm-003", "blah"),
+			old:  testNode("vm-003", "blah"),
+		},
+		{
+			name: "Update own subnet",
+			node: testNode("vm-002", "172.20.2.0/25"),
+			old:  testNode("vm-002", "172.20.2.0/24,fd00::2:0:0/96"),
+		},
+		{
+			name:   "Invalid CIDR",
+			node:   testNode("vm-004", "172.20.4.0/33"),
+			reject: true,
+		},
+		{
+			name:   "Same family",
+			node:   testNode("vm-004", "172.20.4.0/24,172.20.5.0/24"),
+			reject: true,
+		},
+		{
+			name:   "Too many",
+			node:   testNode("vm-004", "172.20.4.0/24,fd00::4:0:0/96,fd00::5:0:0/96"),
+			reject: true,
+		},
+		{
+			name:   "Overlap node",
+			node:   testNode("vm-004", "172.20.0.0/16"),
+			reject: true,
+		},
+		{
+			name:   "Overlap service",
+			node:   testNode("vm-004", "fd00:4000::/120"),
+			reject: true,
+		},
+	}
+	for _, tc := range tcases {
+		res := review(t, srv.URL, tc.node, tc.old)
+		if res.Allowed == tc.reject {
+			t.Fatalf("%s: allowed=%v, %v", tc.name, res.Allowed, res.Result)
+		}
+		if res.Result != nil {
+			t.Logf("%s: %s", tc.name, res.Result.Message)
+		}
+	}
+
+	// Overlap check disabled
+	cfg.RejectOverlap = false
+	res := review(t, srv.URL, testNode("vm-004", "172.20.0.0/16"), nil)
+	if !res.Allowed {
+		t.Fatal("Overlap rejected when disabled")
+	}
+}
+
+func TestOverlapAll(t *testing.T) {
+	const net2 = "kube-node.nordix.org/net2"
+	vm2 := testNode("vm-002", "172.20.2.0/24")
+	vm2.ObjectMeta.Annotations[net2] = "172.21.2.0/24"
+	vm2.Spec.PodCIDRs = []string{"10.244.2.0/24", "fd00:244::2:0/112"}
+	client := fake.NewSimpleClientset(vm2)
+	cfg := &Config{
+		Annotations:   []string{testAnnotation, net2},
+		RejectOverlap: true,
+	}
+	w, err := New(context.TODO(), client, cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	srv := httptest.NewServer(w)
+	defer srv.Close()
+
+	// node Returns a node with annotations net1 and net2 (if not empty)
+	// and pod CIDRs
+	node := func(name, v1, v2 string, podCIDRs ...string) *k8s.Node {
+		n := testNode(name, v1)
+		if v2 != "" {
+			n.ObjectMeta.Annotations[net2] = v2
+		}
+		n.Spec.PodCIDRs = podCIDRs
+		return n
+	}
+	tcases := []struct {
+		name   string
+		node   *k8s.Node
+		reject bool
+	}{
+		{name: "OK", node: node("vm-004", "172.20.4.0/24", "172.21.4.0/24", "10.244.4.0/24")},
+		{name: "Other annotation on other node", node: node("vm-004", "172.21.2.0/25", ""), reject: true},
+		{name: "PodCIDRs on other node", node: node("vm-004", "fd00:244::2:0/120", ""), reject: true},
+		{name: "Other annotation on same node", node: node("vm-004", "172.20.4.0/24", "172.20.4.0/26"), reject: true},
+		{name: "PodCIDRs on same node", node: node("vm-004", "10.244.4.0/26", "", "10.244.4.0/24"), reject: true},
+		{name: "Own node, own annotation", node: node("vm-002", "172.20.2.0/25", "172.21.2.0/24", "10.244.2.0/24")},
+	}
+	for _, tc := range tcases {
+		res := review(t, srv.URL, tc.node, nil)
+		if res.Allowed == tc.reject {
+			t.Fatalf("%s: allowed=%v, %v", tc.name, res.Allowed, res.Result)
+		}
+	}
+}
+
+func TestMutate(t *testing.T) {
+	const resource = "kube-node.nordix.org/ipv4-k8snet"
+	cfg := &Config{
+		Resources: []Resource{{Name: resource, Namespaces: []string{"ipv4"}}},
+	}
+	w, err := New(context.TODO(), fake.NewSimpleClientset(), cfg)
+	if err != nil {
+		t.Fatal("New:", err)
+	}
+	srv := httptest.NewServer(w)
+	defer srv.Close()
+
+	mutate := func(ns string, pod *k8s.Pod) *admission.AdmissionResponse {
+		data, _ := json.Marshal(pod)
+		return post(t, srv.URL, &admission.AdmissionRequest{
+			UID:       "4711",
+			Kind:      meta.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: ns,
+			Operation: admission.Create,
+			Object:    runtime.RawExtension{Raw: data},
+		})
+	}
+	pod := &k8s.Pod{Spec: k8s.PodSpec{Containers: []k8s.Container{
+		{Name: "c1", Resources: k8s.ResourceRequirements{
+			Requests: k8s.ResourceList{k8s.ResourceCPU: *apiresource.NewMilliQuantity(100, apiresource.DecimalSI)},
+		}},
+		{Name: "c2"},
+	}}}
+	res := mutate("ipv4", pod)
+	if !res.Allowed || res.PatchType == nil || *res.PatchType != admission.PatchTypeJSONPatch {
+		t.Fatalf("Expected a patch %+v", res)
+	}
+	var patch []struct {
+		Op    string                   `json:"op"`
+		Path  string                   `json:"path"`
+		Value k8s.ResourceRequirements `json:"value"`
+	}
+	if err := json.Unmarshal(res.Patch, &patch); err != nil {
+		t.Fatal("Invalid patch", err)
+	}
+	if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != "/spec/containers/0/resources" {
+		t.Fatalf("Unexpected patch %s", res.Patch)
+	}
+	if q := patch[0].Value.Limits[resource]; q.Value() != 1 {
+		t.Fatalf("Resource not injected %s", res.Patch)
+	}
+	if q := patch[0].Value.Requests[k8s.ResourceCPU]; q.MilliValue() != 100 {
+		t.Fatalf("Requests not kept %s", res.Patch)
+	}
+
+	// Other namespaces, and PODs that already have the resource, are
+	// not mutated
+	if res := mutate("default", pod); !res.Allowed || res.Patch != nil {
+		t.Fatalf("Unexpected patch in other namespace %s", res.Patch)
+	}
+	pod.Spec.Containers[1].Resources.Limits = k8s.ResourceList{resource: apiresource.MustParse("1")}
+	if res := mutate("ipv4", pod); !res.Allowed || res.Patch != nil {
+		t.Fatalf("Unexpected patch %s", res.Patch)
+	}
+
+	cfg.Resources[0].Name = "example.com/bad/name"
+	if _, err := New(context.TODO(), fake.NewSimpleClientset(), cfg); err == nil {
+		t.Fatal("Invalid resource name accepted")
+	}
+}
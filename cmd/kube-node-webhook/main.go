@@ -0,0 +1,85 @@
+package main
+
+/*
+   Kube-node-webhook is a validating admission webhook for kube-node
+   annotations on K8s node objects, and a mutating webhook that
+   injects extended resources in PODs.
+*/
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/cmd/kube-node-webhook/app"
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+)
+
+var (
+	version string = "unknown"
+)
+
+func main() {
+	flagVersion := flag.Bool("version", false, "Print version")
+	config := flag.String(
+		"config", "/etc/kube-node-webhook/config.json", "Config file")
+	addr := flag.String("addr", ":8443", "Listen address")
+	cert := flag.String("tls-cert", "/etc/kube-node-webhook/tls.crt", "TLS certificate")
+	key := flag.String("tls-key", "/etc/kube-node-webhook/tls.key", "TLS key")
+	loglevel := flag.String("loglevel", "info", "Log level")
+	flag.Parse()
+	if *flagVersion {
+		fmt.Println(version)
+		os.Exit(0)
+	}
+
+	ctx, cancel := signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	zlogger, err := log.ZapLogger("stderr", *loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	ctx = log.NewContext(ctx, zlogger)
+	logger := logr.FromContextOrDiscard(ctx)
+	logger.Info("Started", "version", version, "config", *config, "addr", *addr)
+
+	cfg, err := app.ReadConfig(*config)
+	if err != nil {
+		log.Fatal(ctx, "Read config", "error", err)
+	}
+	clientset, err := util.GetClientset()
+	if err != nil {
+		log.Fatal(ctx, "Get clientset", "error", err)
+	}
+	w, err := app.New(ctx, clientset, cfg)
+	if err != nil {
+		log.Fatal(ctx, "Create webhook", "error", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/validate", w)
+	mux.Handle("/mutate", w)
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		sctx, scancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer scancel()
+		_ = srv.Shutdown(sctx)
+	}()
+	if err := srv.ListenAndServeTLS(*cert, *key); err != http.ErrServerClosed {
+		log.Fatal(ctx, "Serve", "error", err)
+	}
+}
@@ -0,0 +1,311 @@
+package app
+
+/*
+   The agent is a long-running node agent ("kube-node agent") that
+   publishes the free IPv4 addresses per network as an extended
+   resource on the own node object, e.g.
+   "kube-node.nordix.org/ipv4-k8snet". PODs that need IPv4, e.g. in
+   "ipv4-namespaces", can request the resource, so they are not
+   scheduled on nodes where the IPv4 range is exhausted.
+
+   The scheduler subtracts the requests of PODs on the node from the
+   capacity, so the capacity is computed as the allocatable addresses
+   minus the allocations not accounted for by a request:
+
+     capacity = total - allocated + requested
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultResourcePrefix The extended resource is named <prefix><network>
+const DefaultResourcePrefix = "kube-node.nordix.org/ipv4-"
+
+// Agent Publishes free IPv4 addresses as extended resources
+type Agent struct {
+	logger    logr.Logger
+	client    kubernetes.Interface
+	reader    util.NodeReader
+	node      string
+	networks  []*CniConfigIn
+	resources map[string]string // network -> resource name
+}
+
+// AgentMain Parses arguments and runs the agent until the context is
+// cancelled. Returns the exit code
+func AgentMain(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	var confs stringList
+	fs.Var(&confs, "conf", "CNI config file, conf or conflist (may be repeated)")
+	node := fs.String("node", os.Getenv("NODE_NAME"), "Own node name")
+	prefix := fs.String("prefix", DefaultResourcePrefix, "Extended resource name prefix")
+	interval := fs.Duration("interval", 10*time.Second, "Update interval")
+	once := fs.Bool("once", false, "Update once and exit")
+	loglevel := fs.String("loglevel", "info", "Log level")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	zlogger, err := log.ZapLogger("stderr", *loglevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2
+	}
+	ctx = log.NewContext(ctx, zlogger)
+
+	var networks []*CniConfigIn
+	for _, f := range confs {
+		in, err := readAgentConfig(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			return 2
+		}
+		networks = append(networks, in)
+	}
+	clientset, err := util.GetClientset()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2
+	}
+	a, err := NewAgent(ctx, clientset, util.RealNodeReader(), *node, *prefix, networks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2
+	}
+	if *once {
+		if err := a.Update(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			return 1
+		}
+		return 0
+	}
+	a.Run(ctx, *interval)
+	return 0
+}
+
+// readAgentConfig Reads a CNI config (conf or conflist) with a
+// kube-node IPAM
+func readAgentConfig(file string) (*CniConfigIn, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var conf struct {
+		CniConfigIn
+		Plugins []CniConfigIn `json:"plugins"`
+	}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	in := conf.CniConfigIn
+	for _, p := range conf.Plugins {
+		if p.IPAM != nil && p.IPAM.Type == "kube-node" {
+			p.Name, p.CNIVersion = in.Name, in.CNIVersion
+			in = p
+			break
+		}
+	}
+	if in.IPAM == nil || in.IPAM.Type != "kube-node" || in.Name == "" {
+		return nil, fmt.Errorf("%s: No kube-node ipam", file)
+	}
+	return &in, nil
+}
+
+// NewAgent Creates an agent
+func NewAgent(
+	ctx context.Context, client kubernetes.Interface, reader util.NodeReader,
+	node, prefix string, networks []*CniConfigIn) (*Agent, error) {
+	if node == "" {
+		return nil, fmt.Errorf("No node name")
+	}
+	if len(networks) == 0 {
+		return nil, fmt.Errorf("No networks")
+	}
+	a := &Agent{
+		logger:    logr.FromContextOrDiscard(ctx),
+		client:    client,
+		reader:    reader,
+		node:      node,
+		networks:  networks,
+		resources: make(map[string]string),
+	}
+	for _, in := range networks {
+		name := prefix + in.Name
+		if errs := validation.IsQualifiedName(name); len(errs) > 0 {
+			return nil, fmt.Errorf("Invalid resource name %s: %v", name, errs)
+		}
+		a.resources[in.Name] = name
+	}
+	return a, nil
+}
+
+// Run Updates the extended resources every interval until the context
+// is cancelled
+func (a *Agent) Run(ctx context.Context, interval time.Duration) {
+	a.logger.Info("Agent started", "node", a.node, "resources", a.resources)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := a.Update(ctx); err != nil {
+			a.logger.Error(err, "Update")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update Computes the capacities and patches the node status if any
+// differs from the node. The capacity on the node is compared, not the
+// last published, since extended resources are cleared if the kubelet
+// re-registers the node. Networks that fail, or have no IPv4 ranges,
+// are skipped
+func (a *Agent) Update(ctx context.Context) error {
+	requested, err := a.requested(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := a.client.CoreV1().Nodes().Get(ctx, a.node, meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	// The node is read at most once per update
+	node := rangesource.NewOwnNode(a.reader)
+	capacity := make(map[string]string)
+	for _, in := range a.networks {
+		nu, err := agentUtilization(ctx, in, node)
+		if err != nil {
+			a.logger.Error(err, "Utilization", "network", in.Name)
+			continue
+		}
+		if nu.IPv4 == nil {
+			continue
+		}
+		name := a.resources[in.Name]
+		total, _ := nu.IPv4.Total.Int64()
+		allocated, _ := nu.IPv4.Allocated.Int64()
+		c := total - allocated + requested[name]
+		if c < 0 {
+			c = 0
+		}
+		if q, ok := current.Status.Capacity[k8s.ResourceName(name)]; !ok || q.Value() != c {
+			capacity[name] = strconv.FormatInt(c, 10)
+		}
+	}
+	if len(capacity) == 0 {
+		return nil
+	}
+	patch, _ := json.Marshal(map[string]any{
+		"status": map[string]any{"capacity": capacity},
+	})
+	_, err = a.client.CoreV1().Nodes().Patch(
+		ctx, a.node, types.MergePatchType, patch, meta.PatchOptions{}, "status")
+	if err != nil {
+		return err
+	}
+	a.logger.V(1).Info("Capacity updated", "capacity", capacity)
+	return nil
+}
+
+// requested Returns the requested extended resources per name by
+// non-terminated PODs on the node. The effective POD request is used,
+// as by the scheduler
+func (a *Agent) requested(ctx context.Context) (map[string]int64, error) {
+	pods, err := a.client.CoreV1().Pods("").List(ctx, meta.ListOptions{
+		FieldSelector: "spec.nodeName=" + a.node,
+	})
+	if err != nil {
+		return nil, err
+	}
+	requested := make(map[string]int64)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == k8s.PodSucceeded || pod.Status.Phase == k8s.PodFailed {
+			continue
+		}
+		for _, name := range a.resources {
+			requested[name] += podRequest(&pod.Spec, k8s.ResourceName(name))
+		}
+	}
+	return requested, nil
+}
+
+// podRequest Returns the effective request of a resource; the max of
+// the sum for the containers and the request of any init container
+func podRequest(spec *k8s.PodSpec, name k8s.ResourceName) int64 {
+	var sum, initMax int64
+	for i := range spec.Containers {
+		sum += containerRequest(&spec.Containers[i], name)
+	}
+	for i := range spec.InitContainers {
+		if r := containerRequest(&spec.InitContainers[i], name); r > initMax {
+			initMax = r
+		}
+	}
+	if initMax > sum {
+		return initMax
+	}
+	return sum
+}
+
+// containerRequest Returns the request of a resource. The limit is
+// used if only a limit is specified, as the API server defaults it
+func containerRequest(c *k8s.Container, name k8s.ResourceName) int64 {
+	if q, ok := c.Resources.Requests[name]; ok {
+		return q.Value()
+	}
+	if q, ok := c.Resources.Limits[name]; ok {
+		return q.Value()
+	}
+	return 0
+}
+
+// agentUtilization Returns the utilization of a network. The ranges
+// are taken from the cache, or from the range sources if there is no
+// valid cache. Exclusions and reservations are applied
+func agentUtilization(
+	ctx context.Context, in *CniConfigIn, node *rangesource.OwnNode) (*nodeUtilization, error) {
+	o := newOutIpam(ctx, in)
+	if err := o.readCache(ctx); err != nil {
+		src, err := newRangeSource(in, node)
+		if err != nil {
+			return nil, err
+		}
+		cidrs, err := src.GetRanges(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.createHostLocalIPAM(ctx, cidrs); err != nil {
+			return nil, err
+		}
+		if o.ipam.Reservations, err = readReservations(ctx, in.IPAM, node); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if o.exclude, err = newExclusions(in.IPAM); err != nil {
+		return nil, err
+	}
+	ipam, err := o.networkIPAM()
+	if err != nil {
+		return nil, err
+	}
+	return computeUtilization(in.Name, ipam.DataDir, ipam.Ranges)
+}
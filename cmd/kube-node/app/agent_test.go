@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	k8s "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testPod(name string, phase k8s.PodPhase, limits k8s.ResourceList) *k8s.Pod {
+	return &k8s.Pod{
+		ObjectMeta: meta.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: k8s.PodSpec{
+			NodeName: "node1",
+			Containers: []k8s.Container{
+				{Name: "c", Resources: k8s.ResourceRequirements{Limits: limits}},
+			},
+		},
+		Status: k8s.PodStatus{Phase: phase},
+	}
+}
+
+func TestAgent(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			Type:         "kube-node",
+			DataDir:      dir,
+			Annotation:   "example.com/net1",
+			ExcludeFirst: 2,
+		},
+	}
+	// The ranges are read from the cache
+	o := newOutIpam(ctx, in)
+	if err := o.createHostLocalIPAM(ctx, []string{"10.0.0.0/28", "fd00::/120"}); err != nil {
+		t.Fatal(err)
+	}
+	o.writeCache(ctx)
+	cfg := &allocator.Config{Name: "net1", DataDir: dir,
+		Ranges: [][]allocator.Range{{{Subnet: "10.0.0.0/28", RangeStart: "10.0.0.3"}}}}
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := allocator.Add(cfg, &allocator.Args{ContainerID: id, IfName: "eth0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name := k8s.ResourceName(DefaultResourcePrefix + "net1")
+	one := k8s.ResourceList{name: resource.MustParse("1")}
+	client := fake.NewSimpleClientset(
+		&k8s.Node{ObjectMeta: meta.ObjectMeta{Name: "node1"}},
+		testPod("p1", k8s.PodRunning, one),
+		testPod("p2", k8s.PodSucceeded, one),
+		testPod("p3", k8s.PodRunning, nil),
+	)
+	a, err := NewAgent(ctx, client, nil, "node1", DefaultResourcePrefix, []*CniConfigIn{in})
+	if err != nil {
+		t.Fatal("NewAgent:", err)
+	}
+	if err := a.Update(ctx); err != nil {
+		t.Fatal("Update:", err)
+	}
+	node, _ := client.CoreV1().Nodes().Get(ctx, "node1", meta.GetOptions{})
+	// 10.0.0.3-10.0.0.14 (12) - 2 allocated + 1 requested
+	if q := node.Status.Capacity[name]; q.Value() != 11 {
+		t.Fatalf("Expected capacity 11, got %v", node.Status.Capacity)
+	}
+	// No patch if unchanged
+	n := len(client.Actions())
+	if err := a.Update(ctx); err != nil {
+		t.Fatal("Update:", err)
+	}
+	for _, action := range client.Actions()[n:] {
+		if action.GetVerb() == "patch" {
+			t.Fatal("Unexpected patch")
+		}
+	}
+
+	// Republished if cleared, e.g. on node re-registration
+	node.Status.Capacity = nil
+	if _, err := client.CoreV1().Nodes().UpdateStatus(ctx, node, meta.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Update(ctx); err != nil {
+		t.Fatal("Update:", err)
+	}
+	node, _ = client.CoreV1().Nodes().Get(ctx, "node1", meta.GetOptions{})
+	if q := node.Status.Capacity[name]; q.Value() != 11 {
+		t.Fatalf("Expected capacity 11, got %v", node.Status.Capacity)
+	}
+
+	if _, err := NewAgent(ctx, client, nil, "node1", "example.com/bad/", []*CniConfigIn{in}); err == nil {
+		t.Fatal("Invalid resource name accepted")
+	}
+	if _, err := NewAgent(ctx, client, nil, "", DefaultResourcePrefix, []*CniConfigIn{in}); err == nil {
+		t.Fatal("Empty node name accepted")
+	}
+}
+
+func TestReadAgentConfig(t *testing.T) {
+	dir := t.TempDir()
+	conflist := filepath.Join(dir, "10-k8snet.conflist")
+	_ = os.WriteFile(conflist, []byte(`{
+  "name": "k8snet", "cniVersion": "1.0.0",
+  "plugins": [
+    { "type": "bridge", "ipam": { "type": "kube-node", "annotation": "example.com/k8snet" } },
+    { "type": "portmap" }
+  ]
+}`), 0644)
+	in, err := readAgentConfig(conflist)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in.Name != "k8snet" || in.CNIVersion != "1.0.0" || in.IPAM.Annotation != "example.com/k8snet" {
+		t.Fatalf("Unexpected config %+v", in)
+	}
+	conf := filepath.Join(dir, "10-net1.conf")
+	_ = os.WriteFile(conf, []byte(`{"name": "net1", "ipam": {"type": "host-local"}}`), 0644)
+	if _, err := readAgentConfig(conf); err == nil {
+		t.Fatal("Expected error for host-local")
+	}
+}
+
+func TestPodRequest(t *testing.T) {
+	name := k8s.ResourceName(DefaultResourcePrefix + "net1")
+	res := func(v string) k8s.ResourceList {
+		return k8s.ResourceList{name: resource.MustParse(v)}
+	}
+	container := func(requests, limits k8s.ResourceList) k8s.Container {
+		return k8s.Container{Resources: k8s.ResourceRequirements{Requests: requests, Limits: limits}}
+	}
+	tcases := []struct {
+		name   string
+		spec   k8s.PodSpec
+		expect int64
+	}{
+		{name: "Limits", spec: k8s.PodSpec{Containers: []k8s.Container{
+			container(nil, res("1")), container(nil, res("1"))}}, expect: 2},
+		{name: "Requests", spec: k8s.PodSpec{Containers: []k8s.Container{
+			container(res("1"), nil), container(nil, nil)}}, expect: 1},
+		{name: "Init smaller", spec: k8s.PodSpec{
+			InitContainers: []k8s.Container{container(res("1"), nil)},
+			Containers:     []k8s.Container{container(res("2"), nil)}}, expect: 2},
+		{name: "Init larger", spec: k8s.PodSpec{
+			InitContainers: []k8s.Container{container(res("3"), nil), container(res("1"), nil)},
+			Containers:     []k8s.Container{container(res("1"), nil)}}, expect: 3},
+	}
+	for _, tc := range tcases {
+		if r := podRequest(&tc.spec, name); r != tc.expect {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.expect, r)
+		}
+	}
+}
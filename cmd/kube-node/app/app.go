@@ -3,25 +3,33 @@ package app
 /*
    app implements the kube-node IPAM CNI-plugin
 
-   A cache named "kube-node.json" is stored in DataDir. It is a valid
-   host-local config and can be used as-is unless "ipv4-namespaces" is
-   specified.
+   A cache named "kube-node-<hash>.json" is stored in
+   <CacheDir>/<network>, where hash is computed from the config that
+   affects the cached data. It is a valid host-local config and can be
+   used as-is unless "ipv4-namespaces" or "ipv4-quotas" is specified.
 */
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
 	"github.com/Nordix/ipam-node-annotation/pkg/util"
 	"github.com/containernetworking/cni/pkg/invoke"
 	cnitypes "github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
 	"github.com/go-logr/logr"
-	k8s "k8s.io/api/core/v1"
 	//"cmd/go/internal/lockedfile/internal/filelock"
 )
 
@@ -30,33 +38,114 @@ type kubeNodeIPAM struct {
 	Type       string   `json:"type"`
 	Annotation string   `json:"annotation,omitempty"`
 	DataDir    string   `json:"dataDir,omitempty"`
+	CacheDir   string   `json:"cacheDir,omitempty"`
 	IPv4NS     []string `json:"ipv4-namespaces,omitempty"`
 	KubeConfig string   `json:"kubeconfig,omitempty"`
 	LogFile    string   `json:"logfile,omitempty"`
 	LogLevel   string   `json:"loglevel,omitempty"`
+	// LogSinks Used in addition to LogFile
+	LogSinks []log.Sink `json:"logSinks,omitempty"`
+	// LogEncoding "json" (default), "console" or "logfmt"
+	LogEncoding string `json:"logEncoding,omitempty"`
+	// LogLevels Per subsystem: "api", "cache" and "delegate"
+	LogLevels map[string]string `json:"logLevels,omitempty"`
+	// LogRedaction Masked and hashed keys in logged values
+	LogRedaction *log.Redaction `json:"logRedaction,omitempty"`
+	// Range sources in fallback order, e.g. ["annotation","podCIDRs"]
+	RangeSources []string `json:"rangeSources,omitempty"`
+	RangesFile   string   `json:"rangesFile,omitempty"`
+	StaticRanges []string `json:"staticRanges,omitempty"`
+	// Delegate "host-local" (default) or "native"
+	Delegate string `json:"delegate,omitempty"`
+	// Strategy Allocation strategy. Anything but "sequential" requires
+	// the native delegate, which is then the default
+	Strategy string `json:"strategy,omitempty"`
+	// Per-node reservations. The ConfigMap is given as "namespace/name"
+	ReservationsAnnotation string `json:"reservationsAnnotation,omitempty"`
+	ReservationsConfigMap  string `json:"reservationsConfigMap,omitempty"`
+	// Exclusions. Addresses at the start/end of each range, addresses
+	// on host interfaces and a list of addresses or CIDRs
+	ExcludeFirst         int      `json:"excludeFirst,omitempty"`
+	ExcludeLast          int      `json:"excludeLast,omitempty"`
+	ExcludeHostAddresses bool     `json:"excludeHostAddresses,omitempty"`
+	Exclude              []string `json:"exclude,omitempty"`
+	// RoutesAnnotation Extra routes in json format in the own node object
+	RoutesAnnotation string `json:"routesAnnotation,omitempty"`
+	// NetconfAnnotation Routes and DNS in json format in the own node object
+	NetconfAnnotation string `json:"netconfAnnotation,omitempty"`
+	// StaleAllocations What to do with allocations made before a reboot
+	// or for another node object; "quarantine" (default), "clear" or "keep"
+	StaleAllocations string `json:"staleAllocations,omitempty"`
+	// AuditLog A file for json lines, rotated at AuditLogMaxSize MiB
+	AuditLog           string `json:"auditLog,omitempty"`
+	AuditLogMaxSize    int    `json:"auditLogMaxSize,omitempty"`
+	AuditLogMaxBackups int    `json:"auditLogMaxBackups,omitempty"`
+	// MetricsFile A Prometheus textfile, e.g. in the node_exporter
+	// textfile directory. Must end with ".prom"
+	MetricsFile string `json:"metricsFile,omitempty"`
+	// Events K8s Events on failures. Disabled if nil
+	Events *eventConfig `json:"events,omitempty"`
+	// UtilizationAnnotation Allocated/total addresses per family on the
+	// own node object, updated at most every UtilizationInterval seconds
+	UtilizationAnnotation string `json:"utilizationAnnotation,omitempty"`
+	UtilizationInterval   int    `json:"utilizationInterval,omitempty"`
+	// Exhaustion Node condition and/or taint when a family is exhausted
+	Exhaustion *exhaustionConfig `json:"exhaustion,omitempty"`
+	// IPv4Quotas Max IPv4 addresses per namespace on the node. When
+	// exceeded, IPv4QuotaPolicy "ipv6-only" (default) or "fail" applies
+	IPv4Quotas      map[string]int `json:"ipv4-quotas,omitempty"`
+	IPv4QuotaPolicy string         `json:"ipv4-quota-policy,omitempty"`
 }
 type hostLocalIPAM struct {
-	Type    string   `json:"type"`
-	DataDir string   `json:"dataDir,omitempty"`
-	Ranges  []ranges `json:"ranges"`
+	Type    string            `json:"type"`
+	DataDir string            `json:"dataDir,omitempty"`
+	Ranges  []ranges          `json:"ranges"`
+	Routes  []*cnitypes.Route `json:"routes,omitempty"`
+	// DNS Ignored by host-local, added to the result by kube-node
+	DNS *cnitypes.DNS `json:"dns,omitempty"`
+	// KubeNode Cached only, identifies the config the cache was
+	// written for
+	KubeNode *cacheMeta `json:"kube-node,omitempty"`
+	// Reservations Cached only, not passed to host-local
+	Reservations reservations `json:"reservations,omitempty"`
 }
 type ranges []rangeItem
 type rangeItem struct {
-	Subnet string `json:"subnet"`
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart,omitempty"`
+	RangeEnd   string `json:"rangeEnd,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
 }
 
 // Define input and output (json) to this plugin
 type CniConfigIn struct {
-	Name             string        `json:"name"`
-	CNIVersion       string        `json:"cniVersion"`
-	IsDefaultGateway bool          `json:"isDefaultGateway"`
-	IPAM             *kubeNodeIPAM `json:"ipam"`
+	Name             string         `json:"name"`
+	CNIVersion       string         `json:"cniVersion"`
+	IsDefaultGateway bool           `json:"isDefaultGateway"`
+	IPAM             *kubeNodeIPAM  `json:"ipam"`
+	RuntimeConfig    *runtimeConfig `json:"runtimeConfig,omitempty"`
+	// ValidAttachments Given on GC
+	ValidAttachments []attachment `json:"cni.dev/valid-attachments,omitempty"`
 }
 type cniConfigOut struct {
 	Name             string         `json:"name"`
 	CNIVersion       string         `json:"cniVersion"`
 	IsDefaultGateway bool           `json:"isDefaultGateway,omitempty"`
 	IPAM             *hostLocalIPAM `json:"ipam"`
+	RuntimeConfig    *runtimeConfig `json:"runtimeConfig,omitempty"`
+	ValidAttachments []attachment   `json:"cni.dev/valid-attachments,omitempty"`
+	strategy         string         // Used by the native delegate
+}
+
+// attachment A container interface that is still in use
+type attachment struct {
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+}
+
+// runtimeConfig The "ips" capability, used by e.g. Multus
+type runtimeConfig struct {
+	IPs []string `json:"ips,omitempty"`
 }
 
 // ReadCniConfigIn Reads stdin and creates a CNI config structure.
@@ -76,7 +165,11 @@ func ReadCniConfigIn(ctx context.Context) *CniConfigIn {
 
 // Main Executes the CNI command
 func Main(ctx context.Context, in *CniConfigIn) {
-	logger := logr.FromContextOrDiscard(ctx)
+	// All log lines and CNI errors carry the invocation fields
+	inv := util.NewInvocation(in.Name)
+	ctx = util.WithInvocation(ctx, inv)
+	logger := logr.FromContextOrDiscard(ctx).WithValues(inv.KeysAndValues()...)
+	ctx = logr.NewContext(ctx, logger)
 	trace := logger.V(2)
 	if trace.Enabled() {
 		trace.Info(
@@ -91,68 +184,212 @@ func Main(ctx context.Context, in *CniConfigIn) {
 			return
 		} else {
 			err := fmt.Errorf("No IPAM found")
-			util.CniErrorExit(
+			cniErrorExit(
 				ctx, err, cnitypes.ErrDecodingFailure, "Decode stdin")
 		}
 	}
+	ctx = withAuditLog(ctx, newAuditLog(ctx, in))
+	ctx = withMetrics(ctx, newMetrics(in))
+	ctx = withEvents(ctx, newEventRecorder(in))
 	if in.IPAM.KubeConfig != "" {
 		os.Setenv("KUBECONFIG", in.IPAM.KubeConfig)
 	}
 
+	exec, msg, err := selectDelegate(in.IPAM)
+	if err != nil {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Delegate")
+	}
+	if err := validateStalePolicy(in.IPAM.StaleAllocations); err != nil {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Stale allocations")
+	}
+	if err := validateQuotaPolicy(in.IPAM.IPv4QuotaPolicy); err != nil {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "IPv4 quota")
+	}
+
 	o := newOutIpam(ctx, in)
-	if err := o.readCache(ctx); err != nil {
+	err = o.readCache(ctx)
+	if err == nil && os.Getenv("CNI_COMMAND") == "ADD" {
+		err = o.checkNodeUID(ctx)
+	}
+	metricsFrom(ctx).setCache(err == nil)
+	if err == nil {
+		auditLogFrom(ctx).setRangeSource("cache")
+	} else {
 		// Failed to read from cache. We must read the subnets from
 		// the own K8s node object. This is not a fatal error but can
 		// flood the logs, so use debug loglevel
 		logger.V(1).Error(err, "Read Cache", "file", o.cache)
-		n, err := getOwnNode(ctx, util.RealNodeReader())
+		apiCtx := logr.NewContext(ctx, logger.WithName("api"))
+		node := rangesource.NewOwnNode(
+			newTimedNodeReader(util.RealNodeReader(), metricsFrom(ctx)))
+		eventsFrom(ctx).setNode(node)
+		src, err := newRangeSource(in, node)
 		if err != nil {
-			util.CniErrorExit(ctx, err, 100, "Get the own node object")
+			cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Range sources")
 		}
-		cidrs, err := getPodCIDRs(ctx, n, o.inCfg.IPAM.Annotation)
+		auditLogFrom(ctx).setRangeSource(src.Name())
+		cidrs, err := src.GetRanges(apiCtx)
 		if err != nil {
-			util.CniErrorExit(ctx, err, 100, "Get PodCIDRs")
+			cniErrorExit(ctx, err, 100, "Get PodCIDRs")
 		}
 		err = o.createHostLocalIPAM(ctx, cidrs)
 		if err != nil {
-			util.CniErrorExit(ctx, err, 100, "CIDR config")
+			cniErrorExit(ctx, err, 100, "CIDR config")
+		}
+		o.ipam.Reservations, err = readReservations(apiCtx, in.IPAM, node)
+		if err != nil {
+			cniErrorExit(ctx, err, 100, "Reservations")
+		}
+		o.ipam.Routes, o.ipam.DNS, err = readNetconf(apiCtx, in.IPAM, node)
+		if err != nil {
+			cniErrorExit(ctx, err, 100, "Routes and DNS")
+		}
+		if n := node.Peek(); n != nil {
+			o.meta.NodeUID = string(n.ObjectMeta.UID)
+			o.meta.NodeName = n.ObjectMeta.Name
+		}
+		err = checkStale(ctx, in, dataDirState{
+			BootID: o.meta.BootID, NodeUID: o.meta.NodeUID})
+		if err != nil {
+			cniErrorExit(ctx, err, 100, "Stale allocations")
 		}
 		o.writeCache(ctx)
 	}
 
-	err := execChained(ctx, o.computeOutData(ctx))
+	o.ips, err = requestedIPs(in)
 	if err != nil {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Requested IPs")
+	}
+	o.exclude, err = newExclusions(in.IPAM)
+	if err != nil {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Exclusions")
+	}
+	if len(o.ips) == 0 {
+		o.ips = o.ipam.Reservations.lookup(
+			getK8sNamespace(ctx), util.CniArg("K8S_POD_NAME"))
+	}
+	out, err := o.computeOutData(ctx)
+	if errors.Is(err, errQuotaExceeded) {
+		cniErrorExit(ctx, err, 100, "IPv4 quota")
+	}
+	if errors.Is(err, errReserved) {
+		cniErrorExit(ctx, err, cnitypes.ErrInvalidNetworkConfig, "Requested IP reserved")
+	}
+	// rollback Releases a quota reservation on failure
+	rollback := func() {
+		err := releaseQuota(in,
+			os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_IFNAME"))
+		if err != nil {
+			logger.V(1).Error(err, "IPv4 quota release")
+		}
+	}
+	if err != nil {
+		rollback()
+		cniErrorExit(ctx, err, 100, "Exclude addresses")
+	}
+	network, err := o.networkIPAM()
+	if err != nil {
+		logger.V(1).Error(err, "Network ranges")
+	}
+	metricsFrom(ctx).setRanges(network)
+	if os.Getenv("CNI_COMMAND") == "ADD" {
+		// The network ranges, but with the POD's own reservations
+		if err := checkRequestedIPs(o.ips, out.IPAM); err != nil {
+			// The cache may be outdated
+			o.deleteCache()
+			rollback()
+			cniErrorExit(
+				ctx, err, cnitypes.ErrInvalidNetworkConfig,
+				"Requested IP outside node ranges")
+		}
+	}
+
+	nodeName := ownNodeName(o.meta.NodeName)
+	if err := exec(logr.NewContext(ctx, logger.WithName("delegate")), out); err != nil {
 		o.deleteCache()
-		util.CniErrorExit(ctx, err, 100, "Invoke host-local ipam")
+		rollback()
+		if isExhausted(err) {
+			markExhausted(ctx, in, nodeName, exhaustedFamily(err))
+			cniErrorExit(ctx, err, errCodeExhausted, "Addresses exhausted")
+		}
+		cniErrorExit(ctx, err, 100, msg)
+	}
+	err = tagNamespace(in, getK8sNamespace(ctx),
+		os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_IFNAME"))
+	if err != nil {
+		logger.V(1).Error(err, "IPv4 quota tags")
 	}
+	updateUtilization(ctx, in, network, nodeName)
+	clearExhausted(ctx, in, network, nodeName)
+	auditLogFrom(ctx).write(nil, 0)
+	metricsFrom(ctx).write(ctx, 0)
 }
 
 // outIpam handles the chained IPAM CNI-plugin, currently "host-local" only
 type outIpam struct {
-	logger logr.Logger
-	trace  logr.Logger
-	inCfg  *CniConfigIn
-	cache  string
-	ipam   *hostLocalIPAM // To/from cache
+	logger  logr.Logger
+	trace   logr.Logger
+	inCfg   *CniConfigIn
+	cache   string
+	ipam    *hostLocalIPAM // To/from cache
+	ips     []net.IP       // Requested IPs
+	exclude *exclusions
+	meta    cacheMeta
+}
+
+// cacheMeta Stored in the cache to detect a cache written for another
+// network or config, or before a reboot
+type cacheMeta struct {
+	Network    string `json:"network"`
+	ConfigHash string `json:"configHash"`
+	BootID     string `json:"bootID,omitempty"`
+	NodeUID    string `json:"nodeUID,omitempty"`  // Not compared
+	NodeName   string `json:"nodeName,omitempty"` // Not compared
 }
 
 // newOutIpam Create a out-ipam handler
 func newOutIpam(
 	ctx context.Context, inCfg *CniConfigIn) *outIpam {
 	o := outIpam{
-		inCfg:  inCfg,
-		logger: logr.FromContextOrDiscard(ctx),
-		ipam:   &hostLocalIPAM{},
+		inCfg:   inCfg,
+		logger:  logr.FromContextOrDiscard(ctx).WithName("cache"),
+		ipam:    &hostLocalIPAM{},
+		exclude: &exclusions{},
 	}
 	o.trace = o.logger.V(2)
-	dataDir := inCfg.IPAM.DataDir
-	if dataDir == "" {
-		dataDir = "/var/lib/cni/networks/" + inCfg.Name
-	}
-	o.cache = dataDir + "/kube-node.json"
+	o.meta = cacheMeta{Network: inCfg.Name, ConfigHash: configHash(inCfg)}
+	o.meta.BootID, _ = util.BootID()
+	o.cache = filepath.Join(
+		cacheDir(inCfg), "kube-node-"+o.meta.ConfigHash+".json")
 	return &o
 }
 
+// cacheDir Returns the directory for the cache and other kube-node
+// state for the network
+func cacheDir(in *CniConfigIn) string {
+	dir := in.IPAM.CacheDir
+	if dir == "" {
+		dir = in.IPAM.DataDir
+	}
+	if dir == "" {
+		dir = allocator.DefaultDataDir
+	}
+	return filepath.Join(dir, in.Name)
+}
+
+// configHash Returns a hash of the config that affects the cached data
+func configHash(in *CniConfigIn) string {
+	ipam := in.IPAM
+	data, _ := json.Marshal([]any{
+		in.Name, ipam.DataDir, ipam.Annotation, ipam.RangeSources,
+		ipam.RangesFile, ipam.StaticRanges, ipam.ReservationsAnnotation,
+		ipam.ReservationsConfigMap, ipam.RoutesAnnotation,
+		ipam.NetconfAnnotation,
+	})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
 // readCache Tries to read the configuration from cache
 func (o *outIpam) readCache(ctx context.Context) error {
 	cacheData, err := os.ReadFile(o.cache)
@@ -165,18 +402,27 @@ func (o *outIpam) readCache(ctx context.Context) error {
 	if err := validateHostLocalIPAM(o.ipam); err != nil {
 		return err
 	}
+	meta := o.ipam.KubeNode
+	if meta == nil || meta.Network != o.meta.Network || meta.ConfigHash != o.meta.ConfigHash {
+		return fmt.Errorf("Cache written for another network or config")
+	}
+	if meta.BootID != o.meta.BootID {
+		return fmt.Errorf("Cache written before reboot")
+	}
+	o.meta.NodeUID, o.meta.NodeName = meta.NodeUID, meta.NodeName
 	o.trace.Info("Cache read", "data", o.ipam)
 	return nil
 }
 
 // computeOutData Compute data for the chained ipam (host-local).
 // Prerequisite: The host-local config must be read from cache or
-// created in o.ipam
-func (o *outIpam) computeOutData(ctx context.Context) *cniConfigOut {
+// created in o.ipam. Excluded addresses and reserved addresses, except
+// the requested ones, are removed from the ranges
+func (o *outIpam) computeOutData(ctx context.Context) (*cniConfigOut, error) {
 	if o.trace.Enabled() {
 		o.trace.Info(
 			"Compute data for the chained ipam",
-			"NS", getK8sNamespace(ctx), "ipv4-namespaces", o.inCfg.IPAM.IPv4NS)
+			"podNamespace", getK8sNamespace(ctx), "ipv4-namespaces", o.inCfg.IPAM.IPv4NS)
 	}
 
 	// Check if we shall assign an IPv4 address. If any problem occur
@@ -193,8 +439,34 @@ func (o *outIpam) computeOutData(ctx context.Context) *cniConfigOut {
 			}
 		}
 	}
+	// A POD must not take an address reserved for another POD
+	if os.Getenv("CNI_COMMAND") == "ADD" {
+		err := o.ipam.Reservations.checkRequested(
+			getK8sNamespace(ctx), util.CniArg("K8S_POD_NAME"), o.ips)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if assignIPv4 && os.Getenv("CNI_COMMAND") == "ADD" {
+		err := reserveQuota(o.inCfg, getK8sNamespace(ctx),
+			os.Getenv("CNI_CONTAINERID"), os.Getenv("CNI_IFNAME"))
+		if errors.Is(err, errQuotaExceeded) {
+			// IPv6-only is not possible without an IPv6 range or
+			// with a requested IPv4 address
+			if o.inCfg.IPAM.IPv4QuotaPolicy == quotaFail ||
+				!hasIPv6Range(o.ipam.Ranges) || hasIPv4(o.ips) {
+				return nil, err
+			}
+			logr.FromContextOrDiscard(ctx).V(1).Info("IPv6 only", "reason", err.Error())
+			assignIPv4 = false
+		} else if err != nil {
+			logr.FromContextOrDiscard(ctx).V(1).Error(err, "IPv4 quota")
+		}
+	}
 
 	hostLocalCfg := *o.ipam
+	hostLocalCfg.Reservations = nil
+	hostLocalCfg.KubeNode = nil
 	if !assignIPv4 {
 		// We must create a hostLocalCfg without IPv4 addressed
 		hostLocalCfg.Ranges = nil
@@ -209,14 +481,92 @@ func (o *outIpam) computeOutData(ctx context.Context) *cniConfigOut {
 		}
 	}
 
+	// Routes are added for families with ranges only
+	var routes []*cnitypes.Route
+	if o.inCfg.IsDefaultGateway {
+		routes = defaultRoutes(hostLocalCfg.Ranges)
+	}
+	for _, r := range familyRoutes(o.ipam.Routes, hostLocalCfg.Ranges) {
+		if !containsRoute(routes, r) {
+			routes = append(routes, r)
+		}
+	}
+	hostLocalCfg.Routes = routes
+
+	var exclude []net.IP
+	for _, ip := range o.ipam.Reservations.all() {
+		if !containsIP(o.ips, ip) {
+			exclude = append(exclude, ip)
+		}
+	}
+	if err := o.exclude.with(exclude).apply(&hostLocalCfg); err != nil {
+		return nil, err
+	}
+
 	out := cniConfigOut{
 		Name:             o.inCfg.Name,
 		CNIVersion:       o.inCfg.CNIVersion,
 		IsDefaultGateway: o.inCfg.IsDefaultGateway,
 		IPAM:             &hostLocalCfg,
+		ValidAttachments: o.inCfg.ValidAttachments,
+		strategy:         o.inCfg.IPAM.Strategy,
+	}
+	if len(o.ips) > 0 {
+		out.RuntimeConfig = &runtimeConfig{}
+		for _, ip := range o.ips {
+			out.RuntimeConfig.IPs = append(out.RuntimeConfig.IPs, ip.String())
+		}
 	}
 	o.trace.Info("To host-local", "config", &out)
-	return &out
+	return &out, nil
+}
+
+// networkIPAM Returns the ranges of the network with exclusions and all
+// reservations applied. Unlike the output of computeOutData it doesn't
+// depend on the POD, so it is used for the address usage on the node
+func (o *outIpam) networkIPAM() (*hostLocalIPAM, error) {
+	ipam := *o.ipam
+	if err := o.exclude.with(o.ipam.Reservations.all()).apply(&ipam); err != nil {
+		return nil, err
+	}
+	return &ipam, nil
+}
+
+// hasIPv6Range Returns true if any range set is IPv6
+func hasIPv6Range(sets []ranges) bool {
+	for _, r := range sets {
+		if ip, _, _ := net.ParseCIDR(r[0].Subnet); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func hasIPv4(ips []net.IP) bool {
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRoute(routes []*cnitypes.Route, route *cnitypes.Route) bool {
+	for _, r := range routes {
+		if r.Dst.String() == route.Dst.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (o *outIpam) createHostLocalIPAM(
@@ -237,6 +587,8 @@ func (o *outIpam) createHostLocalIPAM(
 }
 
 func (o *outIpam) writeCache(ctx context.Context) {
+	meta := o.meta
+	o.ipam.KubeNode = &meta
 	data, err := json.Marshal(o.ipam)
 	if err != nil {
 		panic(err) // Shouldn't happen
@@ -245,9 +597,25 @@ func (o *outIpam) writeCache(ctx context.Context) {
 	if err := os.WriteFile(o.cache, data, 0666); err != nil {
 		// It is not a fatal error but can flood the logs, so use debug level
 		o.logger.V(1).Error(err, "Write Cache", "file", o.cache)
+		return
+	}
+	// Remove caches written for an old config. Other kube-node files,
+	// e.g. the stale allocations state, may be in the same directory
+	old, _ := filepath.Glob(filepath.Join(filepath.Dir(o.cache), "kube-node-*.json"))
+	for _, f := range old {
+		if f != o.cache && isCacheFile(filepath.Base(f)) {
+			_ = os.Remove(f)
+		}
 	}
 }
 
+// isCacheFile Returns true for "kube-node-<configHash>.json"
+func isCacheFile(name string) bool {
+	hash := strings.TrimSuffix(strings.TrimPrefix(name, "kube-node-"), ".json")
+	_, err := hex.DecodeString(hash)
+	return len(hash) == 12 && err == nil
+}
+
 func (o *outIpam) deleteCache() {
 	_ = os.Remove(o.cache)
 }
@@ -274,8 +642,18 @@ func execChained(ctx context.Context, out *cniConfigOut) error {
 		return err
 	}
 
+	// DNS is not supported by host-local
+	if os.Getenv("CNI_COMMAND") == "ADD" && out.IPAM.DNS != nil {
+		if res, err = addDNS(res, out.CNIVersion, out.IPAM.DNS); err != nil {
+			return err
+		}
+	}
+
 	// Output the result
 	os.Stdout.Write(res)
+	if os.Getenv("CNI_COMMAND") == "ADD" {
+		auditLogFrom(ctx).setResultIPs(res, out.CNIVersion)
+	}
 
 	// Verbose logging
 	logger := logr.FromContextOrDiscard(ctx)
@@ -295,60 +673,211 @@ func execChained(ctx context.Context, out *cniConfigOut) error {
 	return nil
 }
 
-func getOwnNode(ctx context.Context, nodeReader util.NodeReader) (*k8s.Node, error) {
-	// If the NODE_NAME environment variable is specified it's assumed
-	// to be correct
-	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
-		n, err := nodeReader.GetNode(ctx, nodeName)
-		if err != nil {
-			return nil, err
+// newRangeSource Returns the configured range sources. If no sources
+// are configured the annotation is used if specified, else spec.podCIDRs
+func newRangeSource(
+	in *CniConfigIn, node *rangesource.OwnNode) (rangesource.RangeSource, error) {
+	names := in.IPAM.RangeSources
+	if len(names) == 0 {
+		if in.IPAM.Annotation != "" {
+			names = []string{rangesource.Annotation}
+		} else {
+			names = []string{rangesource.PodCIDRs}
 		}
-		return n, nil
 	}
+	return rangesource.NewChain(names, &rangesource.Config{
+		Annotation: in.IPAM.Annotation,
+		File:       in.IPAM.RangesFile,
+		Network:    in.Name,
+		Ranges:     in.IPAM.StaticRanges,
+		Node:       node,
+	})
+}
 
-	nodes, err := nodeReader.GetNodes(ctx)
-	if err != nil {
-		return nil, err
+// delegateFn Executes the CNI command in the delegate ipam
+type delegateFn func(ctx context.Context, out *cniConfigOut) error
+
+// selectDelegate Returns the delegate and a message used on failure.
+// Allocation strategies other than sequential needs the native delegate
+func selectDelegate(ipam *kubeNodeIPAM) (delegateFn, string, error) {
+	if err := allocator.ValidateStrategy(ipam.Strategy); err != nil {
+		return nil, "", err
+	}
+	sequential := ipam.Strategy == "" || ipam.Strategy == allocator.Sequential
+	switch ipam.Delegate {
+	case "":
+		if sequential {
+			return execChained, "Invoke host-local ipam", nil
+		}
+		return execNative, "Native allocator", nil
+	case "host-local":
+		if !sequential {
+			return nil, "", fmt.Errorf(
+				"Strategy %s not supported by host-local", ipam.Strategy)
+		}
+		return execChained, "Invoke host-local ipam", nil
+	case "native":
+		return execNative, "Native allocator", nil
 	}
-	if n := util.FindOwnNode(ctx, nodes); n != nil {
-		return n, nil
+	return nil, "", fmt.Errorf("Unknown delegate [%s]", ipam.Delegate)
+}
+
+// allocatorRanges Converts range sets to the allocator format
+func allocatorRanges(in []ranges) [][]allocator.Range {
+	var sets [][]allocator.Range
+	for _, r := range in {
+		var set []allocator.Range
+		for _, ri := range r {
+			set = append(set, allocator.Range{
+				Subnet:     ri.Subnet,
+				RangeStart: ri.RangeStart,
+				RangeEnd:   ri.RangeEnd,
+				Gateway:    ri.Gateway,
+			})
+		}
+		sets = append(sets, set)
 	}
-	return nil, fmt.Errorf("Own node object not found")
+	return sets
 }
 
-// getPodCIDRs Get PodCIDR from the own K8s node object
-func getPodCIDRs(
-	ctx context.Context, n *k8s.Node, annotation string) ([]string, error) {
-	if annotation == "" {
-		// No annotation. Get the PodCIDRs from the node.spec
-		if n.Spec.PodCIDRs == nil {
-			return nil, fmt.Errorf("No spec.podCIDRs found")
+// nativeVersions The versions supported by the native delegate. Results
+// are encoded with the 1.0.0 types, so 1.1.0 is not advertised even
+// though GC and STATUS are handled
+var nativeVersions = version.PluginSupports(
+	"0.1.0", "0.2.0", "0.3.0", "0.3.1", "0.4.0", "1.0.0")
+
+// execNative Executes the command using the in-process allocator
+// instead of host-local. The on-disk format is the same as for
+// host-local
+func execNative(ctx context.Context, out *cniConfigOut) error {
+	cfg := &allocator.Config{
+		Name:     out.Name,
+		DataDir:  out.IPAM.DataDir,
+		Ranges:   allocatorRanges(out.IPAM.Ranges),
+		Strategy: out.strategy,
+	}
+	args := &allocator.Args{
+		ContainerID:  os.Getenv("CNI_CONTAINERID"),
+		IfName:       os.Getenv("CNI_IFNAME"),
+		PodNamespace: getK8sNamespace(ctx),
+		PodName:      util.CniArg("K8S_POD_NAME"),
+	}
+	if out.RuntimeConfig != nil {
+		for _, s := range out.RuntimeConfig.IPs {
+			args.IPs = append(args.IPs, net.ParseIP(s))
 		}
-		return n.Spec.PodCIDRs, nil
 	}
 
-	if c, ok := n.ObjectMeta.Annotations[annotation]; ok {
-		podCIDRs := strings.Split(c, ",")
-		for _, cidr := range podCIDRs {
-			if _, _, err := net.ParseCIDR(cidr); err != nil {
-				return nil, err
-			}
+	switch cmd := os.Getenv("CNI_COMMAND"); cmd {
+	case "ADD":
+		res, err := allocator.Add(cfg, args)
+		if err != nil {
+			return err
+		}
+		res.Routes = out.IPAM.Routes
+		auditLogFrom(ctx).setIPs(res.IPs)
+		if out.IPAM.DNS != nil {
+			mergeDNS(&res.DNS, out.IPAM.DNS)
 		}
-		return podCIDRs, nil
+		logr.FromContextOrDiscard(ctx).V(2).Info("execNative result", "result", res)
+		cniVersion := out.CNIVersion
+		if cniVersion == "" {
+			cniVersion = current.ImplementedSpecVersion
+		}
+		return cnitypes.PrintResult(res, cniVersion)
+	case "DEL":
+		return allocator.Del(cfg, args)
+	case "CHECK":
+		return allocator.Check(cfg, args)
+	case "GC":
+		var valid []allocator.Args
+		for _, a := range out.ValidAttachments {
+			valid = append(valid, allocator.Args{ContainerID: a.ContainerID, IfName: a.IfName})
+		}
+		return allocator.GC(cfg, valid)
+	case "STATUS":
+		return allocator.Status(cfg)
+	case "VERSION":
+		return nativeVersions.Encode(os.Stdout)
+	default:
+		return fmt.Errorf("Unknown CNI_COMMAND [%s]", cmd)
 	}
-	return nil, fmt.Errorf("Annotation not found")
 }
 
 func getK8sNamespace(ctx context.Context) string {
 	// The K8s namespace is found in $CNI_ARGS (or not?)
-	if cniArgs := os.Getenv("CNI_ARGS"); cniArgs != "" {
-		for _, s := range strings.Split(cniArgs, ";") {
-			if v, ok := strings.CutPrefix(s, "K8S_POD_NAMESPACE="); ok {
-				return v
+	return util.CniArg("K8S_POD_NAMESPACE")
+}
+
+// requestedIPs Returns the IPs requested in runtimeConfig "ips" and
+// with "IP=" in $CNI_ARGS. Addresses may be specified with or without
+// a prefix length, and IP= may contain a comma separated list
+func requestedIPs(in *CniConfigIn) ([]net.IP, error) {
+	var items []string
+	if in.RuntimeConfig != nil {
+		items = append(items, in.RuntimeConfig.IPs...)
+	}
+	if v := util.CniArg("IP"); v != "" {
+		items = append(items, strings.Split(v, ",")...)
+	}
+	var ips []net.IP
+	seen := make(map[string]bool)
+	for _, item := range items {
+		item = strings.TrimSpace(item)
+		ip := net.ParseIP(item)
+		if ip == nil {
+			var err error
+			if ip, _, err = net.ParseCIDR(item); err != nil {
+				return nil, fmt.Errorf("Invalid IP [%s]", item)
+			}
+		}
+		if !seen[ip.String()] {
+			seen[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
+// checkRequestedIPs Checks that all requested IPs are within the
+// ranges, and that at most one address per range set is requested.
+// The ranges must have exclusions and reservations applied, so
+// excluded addresses and addresses outside rangeStart/rangeEnd are
+// rejected
+func checkRequestedIPs(ips []net.IP, ipam *hostLocalIPAM) error {
+	used := make(map[int]bool)
+	for _, ip := range ips {
+		found := false
+		for i, r := range ipam.Ranges {
+			for _, item := range r {
+				if inRange(item, ip) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
 			}
+			if used[i] {
+				return fmt.Errorf("More than one IP requested in %s", r[0].Subnet)
+			}
+			used[i] = true
+			break
+		}
+		if !found {
+			var subnets []string
+			for _, r := range ipam.Ranges {
+				if _, subnet, err := net.ParseCIDR(r[0].Subnet); err == nil && subnet.Contains(ip) {
+					return fmt.Errorf(
+						"Requested IP %s excluded or outside the range in %s", ip, r[0].Subnet)
+				}
+				subnets = append(subnets, r[0].Subnet)
+			}
+			return fmt.Errorf(
+				"Requested IP %s not in %s", ip, strings.Join(subnets, ","))
 		}
 	}
-	return ""
+	return nil
 }
 
 // validateHostLocalIPAM Validates that the type is "host-local" and
@@ -358,25 +887,12 @@ func validateHostLocalIPAM(ipam *hostLocalIPAM) error {
 	if ipam.Type != "host-local" {
 		return fmt.Errorf("Wrong Type")
 	}
-	if len(ipam.Ranges) == 0 {
-		return fmt.Errorf("No Ranges")
-	}
-	if len(ipam.Ranges) > 2 {
-		return fmt.Errorf("Too many Ranges")
-	}
-	isIPv4 := make([]bool, 0, 2)
+	cidrs := make([]string, 0, len(ipam.Ranges))
 	for _, ri := range ipam.Ranges {
 		if len(ri) != 1 {
 			return fmt.Errorf("Unsupported Range item")
 		}
-		if ip, _, err := net.ParseCIDR(ri[0].Subnet); err != nil {
-			return fmt.Errorf("Invalid subnet %v", err)
-		} else {
-			isIPv4 = append(isIPv4, ip.To4() != nil)
-		}
+		cidrs = append(cidrs, ri[0].Subnet)
 	}
-	if len(isIPv4) == 2 && isIPv4[0] == isIPv4[1] {
-		return fmt.Errorf("Subnets of same family")
-	}
-	return nil
+	return rangesource.Validate(cidrs)
 }
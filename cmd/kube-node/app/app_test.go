@@ -4,9 +4,17 @@ package app
 
 import (
 	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
 	"github.com/go-logr/logr"
+	"github.com/go-logr/zapr"
 )
 
 func TestHostLocalIPAMValidation(t *testing.T) {
@@ -169,3 +177,283 @@ func TestCache(t *testing.T) {
 	}
 	o.deleteCache()
 }
+
+func TestCacheMismatch(t *testing.T) {
+	ctx := context.TODO()
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{CacheDir: dir, Annotation: "example.com/net1"},
+	}
+	o := newOutIpam(ctx, in)
+	if err := o.createHostLocalIPAM(ctx, []string{"10.0.0.0/24"}); err != nil {
+		t.Fatal("createHostLocalIPAM:", err)
+	}
+	o.writeCache(ctx)
+	if err := newOutIpam(ctx, in).readCache(ctx); err != nil {
+		t.Fatal("readCache:", err)
+	}
+
+	// Another config gives another cache file
+	in.IPAM.Annotation = "example.com/net2"
+	o2 := newOutIpam(ctx, in)
+	if o2.cache == o.cache {
+		t.Fatal("Same cache for different configs", o.cache)
+	}
+	if err := o2.readCache(ctx); err == nil {
+		t.Fatal("Cache for another config read")
+	}
+	// A cache written for another network must be refused
+	o2.cache = o.cache
+	if err := o2.readCache(ctx); err == nil {
+		t.Fatal("Cache for another config accepted")
+	}
+	// Old caches are removed on write, but not other kube-node files
+	others := []string{stateFile, eventStateFile, utilizationStateFile, quotaTagFile}
+	for _, f := range others {
+		_ = os.WriteFile(filepath.Join(filepath.Dir(o.cache), f), []byte("{}"), 0644)
+	}
+	o2.cache = filepath.Join(filepath.Dir(o.cache), "kube-node-"+o2.meta.ConfigHash+".json")
+	o2.writeCache(ctx)
+	if _, err := os.Stat(o.cache); !os.IsNotExist(err) {
+		t.Fatal("Old cache not removed")
+	}
+	for _, f := range others {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(o.cache), f)); err != nil {
+			t.Fatal("Removed on cache write", f)
+		}
+	}
+}
+
+func TestRequestedIPs(t *testing.T) {
+	ipam := &hostLocalIPAM{
+		Type: "host-local",
+		Ranges: []ranges{
+			[]rangeItem{{Subnet: "10.0.0.0/24"}},
+			[]rangeItem{{Subnet: "fd00::/120"}},
+		},
+	}
+	tcases := []struct {
+		name        string
+		ips         []string
+		cniArgs     string
+		expect      int
+		expectError bool
+	}{
+		{
+			name: "None",
+		},
+		{
+			name:   "Runtime config",
+			ips:    []string{"10.0.0.5/24", "fd00::5"},
+			expect: 2,
+		},
+		{
+			name:    "CNI_ARGS",
+			cniArgs: "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;IP=10.0.0.5",
+			expect:  1,
+		},
+		{
+			name:    "Both",
+			ips:     []string{"10.0.0.5/24"},
+			cniArgs: "IP=10.0.0.5,fd00::5",
+			expect:  2,
+		},
+		{
+			name:        "Invalid",
+			ips:         []string{"10.0.0.500"},
+			expectError: true,
+		},
+		{
+			name:        "Outside",
+			ips:         []string{"10.0.1.5"},
+			expect:      1,
+			expectError: true,
+		},
+		{
+			name:        "Two in range",
+			ips:         []string{"10.0.0.5", "10.0.0.6"},
+			expect:      2,
+			expectError: true,
+		},
+	}
+	defer os.Unsetenv("CNI_ARGS")
+	for _, tc := range tcases {
+		os.Setenv("CNI_ARGS", tc.cniArgs)
+		in := &CniConfigIn{RuntimeConfig: &runtimeConfig{IPs: tc.ips}}
+		ips, err := requestedIPs(in)
+		if err == nil {
+			if len(ips) != tc.expect {
+				t.Fatalf("%s: expected %d IPs, got %v", tc.name, tc.expect, ips)
+			}
+			err = checkRequestedIPs(ips, ipam)
+		}
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+		t.Logf("%s: err %v\n", tc.name, err)
+	}
+}
+
+func TestCheckRequestedIPsExcluded(t *testing.T) {
+	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE=default;K8S_POD_NAME=pod1")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+	exclude, err := newExclusions(&kubeNodeIPAM{
+		ExcludeFirst: 2, Exclude: []string{"10.0.0.100/30"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcases := []struct {
+		ip      string
+		invalid bool
+	}{
+		{ip: "10.0.0.20"},
+		{ip: "10.0.0.2", invalid: true},   // excludeFirst
+		{ip: "10.0.0.101", invalid: true}, // exclude
+		{ip: "10.0.0.210", invalid: true}, // After rangeEnd
+		{ip: "fd00::5"},
+		{ip: "fd00::50", invalid: true}, // Before rangeStart in the 2:nd item
+		{ip: "fd00::105"},
+		{ip: "10.0.0.10"},                // Own reservation
+		{ip: "10.0.0.11", invalid: true}, // Reserved for another POD
+	}
+	for _, tc := range tcases {
+		ips := []net.IP{net.ParseIP(tc.ip)}
+		o := &outIpam{
+			logger: logr.Discard(),
+			trace:  logr.Discard(),
+			inCfg:  &CniConfigIn{IPAM: &kubeNodeIPAM{}},
+			ipam: &hostLocalIPAM{
+				Type: "host-local",
+				Ranges: []ranges{
+					{{Subnet: "10.0.0.0/24", RangeEnd: "10.0.0.200"}},
+					{{Subnet: "fd00::/112", RangeEnd: "fd00::10"},
+						{Subnet: "fd00::/112", RangeStart: "fd00::100"}},
+				},
+				Reservations: reservations{
+					"default/pod1": {"10.0.0.10"},
+					"default/pod2": {"10.0.0.11"},
+				},
+			},
+			ips:     ips,
+			exclude: exclude,
+		}
+		out, err := o.computeOutData(context.TODO())
+		if err == nil {
+			err = checkRequestedIPs(ips, out.IPAM)
+		}
+		if (err != nil) != tc.invalid {
+			t.Fatalf("%s: expected invalid=%v, got %v", tc.ip, tc.invalid, err)
+		}
+	}
+}
+
+func TestExecNativeGCStatus(t *testing.T) {
+	dir := t.TempDir()
+	var in CniConfigIn
+	err := json.Unmarshal([]byte(`{
+  "name": "net1", "cniVersion": "1.0.0",
+  "ipam": {"type": "kube-node", "dataDir": "`+dir+`"},
+  "cni.dev/valid-attachments": [{"containerID": "c1", "ifname": "eth0"}]
+}`), &in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &outIpam{
+		logger: logr.Discard(),
+		trace:  logr.Discard(),
+		inCfg:  &in,
+		ipam: &hostLocalIPAM{
+			Type:    "host-local",
+			DataDir: dir,
+			Ranges:  []ranges{{{Subnet: "10.0.0.0/24"}}},
+		},
+		exclude: &exclusions{},
+	}
+	ctx := context.TODO()
+	out, err := o.computeOutData(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &allocator.Config{Name: "net1", DataDir: dir, Ranges: allocatorRanges(out.IPAM.Ranges)}
+	for _, id := range []string{"c1", "c2"} {
+		if _, err := allocator.Add(cfg, &allocator.Args{ContainerID: id, IfName: "eth0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer os.Unsetenv("CNI_COMMAND")
+	os.Setenv("CNI_COMMAND", "STATUS")
+	if err := execNative(ctx, out); err != nil {
+		t.Fatal("STATUS:", err)
+	}
+	os.Setenv("CNI_COMMAND", "GC")
+	if err := execNative(ctx, out); err != nil {
+		t.Fatal("GC:", err)
+	}
+	owners := allocator.Owners("net1", dir)
+	if len(owners) != 1 || owners["10.0.0.2"].ID != "c1" {
+		t.Fatal("Unexpected allocations after GC", owners)
+	}
+	// Not ready with invalid ranges
+	out.IPAM.Ranges = []ranges{{{Subnet: "10.0.0.0/33"}}}
+	os.Setenv("CNI_COMMAND", "STATUS")
+	if err := execNative(ctx, out); err == nil {
+		t.Fatal("STATUS: expected error")
+	}
+	for _, v := range nativeVersions.SupportedVersions() {
+		if v == "1.1.0" {
+			t.Fatal("1.1.0 advertised")
+		}
+	}
+}
+
+// TestLogRedaction The POD identity must be hashed in log records
+// written by the plugin, not only by direct logger calls
+func TestLogRedaction(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "kube-node.log")
+	z, err := log.NewLogger(&log.Config{
+		Sinks:     []log.Sink{{Type: log.SinkFile, Path: logFile}},
+		Level:     "trace",
+		Redaction: &log.Redaction{HashPodIdentity: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE=SECRET-ns;K8S_POD_NAME=SECRET-pod")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+	ctx := logr.NewContext(context.TODO(), zapr.NewLogger(z))
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:    dir,
+			IPv4Quotas: map[string]int{"SECRET-ns": 0},
+		},
+	}
+	o := newOutIpam(ctx, in)
+	o.ipam = &hostLocalIPAM{
+		Type:    "host-local",
+		DataDir: dir,
+		Ranges:  []ranges{{{Subnet: "10.0.0.0/24"}}, {{Subnet: "fd00::/120"}}},
+	}
+	if _, err := o.computeOutData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = z.Sync()
+	data, _ := os.ReadFile(logFile)
+	for _, msg := range []string{"Compute data for the chained ipam", "IPv6 only"} {
+		if !strings.Contains(string(data), msg) {
+			t.Fatalf("Expected %q in:\n%s", msg, data)
+		}
+	}
+	if strings.Contains(string(data), "SECRET") || !strings.Contains(string(data), "sha256:") {
+		t.Fatalf("POD identity not hashed:\n%s", data)
+	}
+}
@@ -0,0 +1,150 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rotate"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// Audit log defaults
+const (
+	defaultAuditLogMaxSize    = 10 // MiB
+	defaultAuditLogMaxBackups = 3
+)
+
+// auditRecord One line in the audit log
+type auditRecord struct {
+	Time         string   `json:"time"`
+	Invocation   string   `json:"invocation,omitempty"`
+	Command      string   `json:"command"`
+	ContainerID  string   `json:"containerID"`
+	Netns        string   `json:"netns,omitempty"`
+	IfName       string   `json:"ifname,omitempty"`
+	PodNamespace string   `json:"podNamespace,omitempty"`
+	PodName      string   `json:"podName,omitempty"`
+	Network      string   `json:"network"`
+	IPs          []string `json:"ips,omitempty"`
+	RangeSource  string   `json:"rangeSource,omitempty"` // "cache" or the range sources
+	Outcome      string   `json:"outcome"`               // "ok" or "error"
+	Code         uint     `json:"code,omitempty"`
+	Error        string   `json:"error,omitempty"`
+}
+
+// auditLog Records one json line per invocation. A nil auditLog is
+// valid and does nothing
+type auditLog struct {
+	file   *rotate.File
+	record auditRecord
+}
+
+type auditKey struct{}
+
+// newAuditLog Returns an audit log for this invocation, or nil if not
+// configured
+func newAuditLog(ctx context.Context, in *CniConfigIn) *auditLog {
+	if in.IPAM == nil || in.IPAM.AuditLog == "" {
+		return nil
+	}
+	maxSize := in.IPAM.AuditLogMaxSize
+	if maxSize == 0 {
+		maxSize = defaultAuditLogMaxSize
+	}
+	maxBackups := in.IPAM.AuditLogMaxBackups
+	if maxBackups == 0 {
+		maxBackups = defaultAuditLogMaxBackups
+	}
+	a := &auditLog{
+		file: rotate.New(in.IPAM.AuditLog, maxSize, maxBackups),
+		record: auditRecord{
+			Command:      os.Getenv("CNI_COMMAND"),
+			ContainerID:  os.Getenv("CNI_CONTAINERID"),
+			Netns:        os.Getenv("CNI_NETNS"),
+			IfName:       os.Getenv("CNI_IFNAME"),
+			PodNamespace: util.CniArg("K8S_POD_NAMESPACE"),
+			PodName:      util.CniArg("K8S_POD_NAME"),
+			Network:      in.Name,
+		},
+	}
+	if i := util.InvocationFrom(ctx); i != nil {
+		a.record.Invocation = i.ID
+	}
+	return a
+}
+
+// withAuditLog Returns a context holding the audit log
+func withAuditLog(ctx context.Context, a *auditLog) context.Context {
+	return context.WithValue(ctx, auditKey{}, a)
+}
+
+// auditLogFrom Returns the audit log in the context, or nil
+func auditLogFrom(ctx context.Context) *auditLog {
+	a, _ := ctx.Value(auditKey{}).(*auditLog)
+	return a
+}
+
+func (a *auditLog) setRangeSource(source string) {
+	if a != nil {
+		a.record.RangeSource = source
+	}
+}
+
+func (a *auditLog) setIPs(ips []*current.IPConfig) {
+	if a == nil {
+		return
+	}
+	for _, ip := range ips {
+		a.record.IPs = append(a.record.IPs, ip.Address.String())
+	}
+}
+
+// setResultIPs Sets the IPs from a result in json format
+func (a *auditLog) setResultIPs(res []byte, cniVersion string) {
+	if a == nil {
+		return
+	}
+	if cniVersion == "" {
+		cniVersion = "0.1.0"
+	}
+	r, err := version.NewResult(cniVersion, res)
+	if err != nil {
+		return
+	}
+	if result, err := current.NewResultFromResult(r); err == nil {
+		a.setIPs(result.IPs)
+	}
+}
+
+// write Writes the record. Errors are ignored, the audit log must not
+// make the invocation fail
+func (a *auditLog) write(err error, code uint) {
+	if a == nil || a.record.Command == "VERSION" {
+		return
+	}
+	a.record.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	a.record.Outcome = "ok"
+	if err != nil {
+		a.record.Outcome = "error"
+		a.record.Code = code
+		a.record.Error = err.Error()
+	}
+	data, e := json.Marshal(&a.record)
+	if e != nil {
+		return
+	}
+	_, _ = a.file.Write(append(data, '\n'))
+}
+
+// cniErrorExit Records the failure in the audit log and metrics, posts
+// an event, emits a CNI formatted error on stdout and exit
+func cniErrorExit(ctx context.Context, err error, code uint, msg string) {
+	auditLogFrom(ctx).write(err, code)
+	metricsFrom(ctx).write(ctx, code)
+	eventsFrom(ctx).post(ctx, err, msg)
+	util.CniErrorExit(ctx, err, code, msg)
+}
@@ -0,0 +1,79 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+)
+
+func TestAuditLog(t *testing.T) {
+	if newAuditLog(context.TODO(), &CniConfigIn{IPAM: &kubeNodeIPAM{}}) != nil {
+		t.Fatal("Audit log without config")
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{AuditLog: path},
+	}
+	env := map[string]string{
+		"CNI_COMMAND":     "ADD",
+		"CNI_CONTAINERID": "c1",
+		"CNI_NETNS":       "/var/run/netns/c1",
+		"CNI_IFNAME":      "eth0",
+		"CNI_ARGS":        "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+
+	inv := util.NewInvocation(in.Name)
+	ctx := util.WithInvocation(context.TODO(), inv)
+	a := newAuditLog(ctx, in)
+	a.setRangeSource("cache")
+	a.setResultIPs([]byte(`{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.2/24"},{"address":"fd00::2/120"}]}`), "1.0.0")
+	a.write(nil, 0)
+	a = newAuditLog(ctx, in)
+	a.setRangeSource("annotation")
+	a.write(fmt.Errorf("no IP addresses available"), 100)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal("Invalid json line:", err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatal("Expected 2 records, got", len(records))
+	}
+	r := records[0]
+	if r.Command != "ADD" || r.ContainerID != "c1" || r.Netns != "/var/run/netns/c1" ||
+		r.IfName != "eth0" || r.PodNamespace != "default" || r.PodName != "web-0" ||
+		r.Network != "net1" || r.Invocation != inv.ID || r.RangeSource != "cache" || r.Outcome != "ok" ||
+		fmt.Sprint(r.IPs) != "[10.0.0.2/24 fd00::2/120]" || r.Time == "" {
+		t.Fatalf("Unexpected record %+v", r)
+	}
+	r = records[1]
+	if r.Outcome != "error" || r.Code != 100 || r.Error == "" || r.IPs != nil {
+		t.Fatalf("Unexpected record %+v", r)
+	}
+
+	// A nil audit log is valid
+	var nilLog *auditLog
+	nilLog.setRangeSource("cache")
+	nilLog.write(nil, 0)
+}
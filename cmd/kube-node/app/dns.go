@@ -0,0 +1,68 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// validateDNS Checks that nameservers are valid addresses
+func validateDNS(dns *cnitypes.DNS) error {
+	for _, ns := range dns.Nameservers {
+		if net.ParseIP(ns) == nil {
+			return fmt.Errorf("Invalid nameserver [%s]", ns)
+		}
+	}
+	for _, s := range dns.Search {
+		if s == "" {
+			return fmt.Errorf("Empty search domain")
+		}
+	}
+	return nil
+}
+
+// mergeDNS Sets the fields that are specified in dns
+func mergeDNS(to *cnitypes.DNS, dns *cnitypes.DNS) {
+	if len(dns.Nameservers) > 0 {
+		to.Nameservers = dns.Nameservers
+	}
+	if dns.Domain != "" {
+		to.Domain = dns.Domain
+	}
+	if len(dns.Search) > 0 {
+		to.Search = dns.Search
+	}
+	if len(dns.Options) > 0 {
+		to.Options = dns.Options
+	}
+}
+
+// addDNS Adds DNS to a result from the delegate and returns it in the
+// same version
+func addDNS(res []byte, cniVersion string, dns *cnitypes.DNS) ([]byte, error) {
+	if cniVersion == "" {
+		cniVersion = "0.1.0" // Same as in the CNI library
+	}
+	r, err := version.NewResult(cniVersion, res)
+	if err != nil {
+		return nil, err
+	}
+	result, err := current.NewResultFromResult(r)
+	if err != nil {
+		return nil, err
+	}
+	mergeDNS(&result.DNS, dns)
+	r, err = result.GetAsVersion(cniVersion)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := r.PrintTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,54 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+)
+
+func TestAddDNS(t *testing.T) {
+	dns := &cnitypes.DNS{
+		Nameservers: []string{"10.0.0.53"},
+		Search:      []string{"example.com"},
+	}
+	tcases := []struct {
+		name       string
+		cniVersion string
+		res        string
+	}{
+		{
+			name:       "1.0.0",
+			cniVersion: "1.0.0",
+			res:        `{"cniVersion":"1.0.0","ips":[{"address":"10.0.0.2/24","gateway":"10.0.0.1"}],"dns":{"domain":"local"}}`,
+		},
+		{
+			name:       "0.3.1",
+			cniVersion: "0.3.1",
+			res:        `{"cniVersion":"0.3.1","ips":[{"version":"4","address":"10.0.0.2/24","gateway":"10.0.0.1"}],"dns":{"domain":"local"}}`,
+		},
+	}
+	for _, tc := range tcases {
+		out, err := addDNS([]byte(tc.res), tc.cniVersion, dns)
+		if err != nil {
+			t.Fatalf("%s: addDNS: %v", tc.name, err)
+		}
+		var res struct {
+			CNIVersion string       `json:"cniVersion"`
+			DNS        cnitypes.DNS `json:"dns"`
+			IPs        []any        `json:"ips"`
+		}
+		if err := json.Unmarshal(out, &res); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res.CNIVersion != tc.cniVersion || len(res.IPs) != 1 {
+			t.Fatalf("%s: unexpected result %s", tc.name, out)
+		}
+		if res.DNS.Domain != "local" || len(res.DNS.Nameservers) != 1 || len(res.DNS.Search) != 1 {
+			t.Fatalf("%s: unexpected DNS %s", tc.name, out)
+		}
+	}
+	if _, err := addDNS([]byte("garbage"), "1.0.0", dns); err == nil {
+		t.Fatal("Expected error")
+	}
+}
@@ -0,0 +1,284 @@
+package app
+
+/*
+   Failures on ADD are posted as K8s Events on the POD, and optionally
+   on the node, so they show up in "kubectl describe". Events are
+   best-effort with a short timeout. The kubelet retries a failed
+   sandbox creation, so events are rate-limited per object, network
+   and reason using a state file with flock(2).
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+	"unicode"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Event defaults
+const (
+	eventStateFile       = "kube-node-events.json"
+	defaultEventInterval = 60   // Seconds
+	defaultEventTimeout  = 2000 // Milliseconds
+	maxEventMessage      = 1024
+)
+
+// eventConfig Configures K8s Events on failures
+type eventConfig struct {
+	// Pod, Node Post events on the POD and/or the own node object
+	Pod  bool `json:"pod,omitempty"`
+	Node bool `json:"node,omitempty"`
+	// Interval Min seconds between events for the same object,
+	// network and reason. Default 60
+	Interval int `json:"interval,omitempty"`
+	// Timeout In milliseconds. Default 2000
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// eventRecorder Posts events for this invocation. A nil eventRecorder
+// is valid and does nothing
+type eventRecorder struct {
+	cfg          eventConfig
+	network      string
+	command      string
+	podNamespace string
+	podName      string
+	podUID       string
+	stateFile    string
+	node         *rangesource.OwnNode
+}
+
+type eventsKey struct{}
+
+// createEvent Creates an event. Replaced in unit-test
+var createEvent = func(ctx context.Context, ev *k8s.Event) error {
+	clientset, err := util.GetClientset()
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Events(ev.Namespace).Create(ctx, ev, meta.CreateOptions{})
+	return err
+}
+
+// newEventRecorder Returns an event recorder for this invocation, or
+// nil if not configured
+func newEventRecorder(in *CniConfigIn) *eventRecorder {
+	if in.IPAM == nil || in.IPAM.Events == nil {
+		return nil
+	}
+	e := &eventRecorder{
+		cfg:          *in.IPAM.Events,
+		network:      in.Name,
+		command:      os.Getenv("CNI_COMMAND"),
+		podNamespace: util.CniArg("K8S_POD_NAMESPACE"),
+		podName:      util.CniArg("K8S_POD_NAME"),
+		podUID:       util.CniArg("K8S_POD_UID"),
+		stateFile:    filepath.Join(cacheDir(in), eventStateFile),
+	}
+	if e.cfg.Interval == 0 {
+		e.cfg.Interval = defaultEventInterval
+	}
+	if e.cfg.Timeout == 0 {
+		e.cfg.Timeout = defaultEventTimeout
+	}
+	return e
+}
+
+// withEvents Returns a context holding the event recorder
+func withEvents(ctx context.Context, e *eventRecorder) context.Context {
+	return context.WithValue(ctx, eventsKey{}, e)
+}
+
+// eventsFrom Returns the event recorder in the context, or nil
+func eventsFrom(ctx context.Context) *eventRecorder {
+	e, _ := ctx.Value(eventsKey{}).(*eventRecorder)
+	return e
+}
+
+// setNode Sets the own node, used for node events if it has been read
+func (e *eventRecorder) setNode(node *rangesource.OwnNode) {
+	if e != nil {
+		e.node = node
+	}
+}
+
+// post Posts a Warning event for a failed ADD. Errors are logged but
+// ignored, events must not change the outcome of the invocation
+func (e *eventRecorder) post(ctx context.Context, err error, msg string) {
+	if e == nil || e.command != "ADD" {
+		return
+	}
+	logger := logr.FromContextOrDiscard(ctx)
+	reason := eventReason(msg)
+	message := fmt.Sprintf("%s: %v (network %s)", msg, err, e.network)
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage]
+	}
+	var events []*k8s.Event
+	if e.cfg.Pod && e.podName != "" {
+		events = append(events, e.newEvent(e.podNamespace, k8s.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  e.podNamespace,
+			Name:       e.podName,
+			UID:        types.UID(e.podUID),
+		}, reason, message))
+	}
+	if e.cfg.Node {
+		if ref := e.nodeRef(); ref != nil {
+			events = append(events, e.newEvent(meta.NamespaceDefault, *ref, reason, message))
+		}
+	}
+	events = e.allow(ctx, events)
+	if len(events) == 0 {
+		return
+	}
+	// The invocation context may have expired, e.g. on an API timeout
+	ctx2, cancel := context.WithTimeout(
+		context.Background(), time.Duration(e.cfg.Timeout)*time.Millisecond)
+	defer cancel()
+	for _, ev := range events {
+		if err := createEvent(ctx2, ev); err != nil {
+			logger.V(1).Error(err, "Create event", "kind", ev.InvolvedObject.Kind)
+		}
+	}
+}
+
+// nodeRef Returns a reference to the own node, or nil if the name is
+// unknown. As for the kubelet, the name is used if the UID is unknown
+func (e *eventRecorder) nodeRef() *k8s.ObjectReference {
+	ref := &k8s.ObjectReference{APIVersion: "v1", Kind: "Node"}
+	if e.node != nil {
+		if n := e.node.Peek(); n != nil {
+			ref.Name = n.ObjectMeta.Name
+			ref.UID = n.ObjectMeta.UID
+		}
+	}
+	if ref.Name == "" {
+		ref.Name = os.Getenv("NODE_NAME")
+	}
+	if ref.Name == "" {
+		ref.Name, _ = os.Hostname()
+	}
+	if ref.Name == "" {
+		return nil
+	}
+	if ref.UID == "" {
+		ref.UID = types.UID(ref.Name)
+	}
+	return ref
+}
+
+func (e *eventRecorder) newEvent(
+	ns string, ref k8s.ObjectReference, reason, message string) *k8s.Event {
+	now := meta.Now()
+	host, _ := os.Hostname()
+	return &k8s.Event{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: ns,
+		},
+		InvolvedObject:      ref,
+		Reason:              reason,
+		Message:             message,
+		Type:                k8s.EventTypeWarning,
+		Source:              k8s.EventSource{Component: "kube-node", Host: host},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: "kube-node",
+		ReportingInstance:   "kube-node-" + host,
+	}
+}
+
+// allow Returns the events not posted within the interval, and
+// records them as posted. On failure to use the state file no events
+// are allowed, to avoid floods
+func (e *eventRecorder) allow(ctx context.Context, events []*k8s.Event) []*k8s.Event {
+	var allowed []*k8s.Event
+	err := updateStateFile(e.stateFile, func(data []byte) []byte {
+		posted := make(map[string]int64)
+		if len(data) > 0 {
+			_ = json.Unmarshal(data, &posted)
+		}
+		now := time.Now().Unix()
+		for k, t := range posted {
+			if now-t >= int64(e.cfg.Interval) {
+				delete(posted, k)
+			}
+		}
+		for _, ev := range events {
+			ref := ev.InvolvedObject
+			key := strings.Join(
+				[]string{ref.Kind, ref.Namespace, ref.Name, e.network, ev.Reason}, "/")
+			if _, ok := posted[key]; !ok {
+				posted[key] = now
+				allowed = append(allowed, ev)
+			}
+		}
+		data, _ = json.Marshal(posted)
+		return data
+	})
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Error(err, "Event state")
+		return nil
+	}
+	return allowed
+}
+
+// updateStateFile Calls fn with the file content under flock(2) and
+// writes the returned data. Nothing is written if fn returns nil
+func updateStateFile(path string, fn func(data []byte) []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // Releases the lock
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if data = fn(data); data == nil {
+		return nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	return err
+}
+
+// eventReason Returns a CamelCase reason from a CNI error message,
+// e.g. "Get PodCIDRs" -> "GetPodCIDRs"
+func eventReason(msg string) string {
+	var b strings.Builder
+	for _, w := range strings.FieldsFunc(msg, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		r := []rune(w)
+		b.WriteString(strings.ToUpper(string(r[0])) + string(r[1:]))
+	}
+	if b.Len() == 0 {
+		return "IPAMFailed"
+	}
+	return b.String()
+}
@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	k8s "k8s.io/api/core/v1"
+)
+
+func TestEvents(t *testing.T) {
+	var events []*k8s.Event
+	orig := createEvent
+	defer func() { createEvent = orig }()
+	createEvent = func(ctx context.Context, ev *k8s.Event) error {
+		events = append(events, ev)
+		return nil
+	}
+	env := map[string]string{
+		"CNI_COMMAND": "ADD",
+		"CNI_ARGS":    "K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0;K8S_POD_UID=1234",
+		"NODE_NAME":   "node1",
+	}
+	for k, v := range env {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	if newEventRecorder(&CniConfigIn{IPAM: &kubeNodeIPAM{}}) != nil {
+		t.Fatal("Events without config")
+	}
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			CacheDir: t.TempDir(),
+			Events:   &eventConfig{Pod: true, Node: true},
+		},
+	}
+	ctx := context.TODO()
+	err := fmt.Errorf("Annotation not found")
+	for i := 0; i < 3; i++ {
+		newEventRecorder(in).post(ctx, err, "Get PodCIDRs")
+	}
+	if len(events) != 2 {
+		t.Fatal("Expected 2 events, got", len(events))
+	}
+	pod, node := events[0], events[1]
+	if pod.Namespace != "default" || pod.InvolvedObject.Kind != "Pod" ||
+		pod.InvolvedObject.Name != "web-0" || pod.InvolvedObject.UID != "1234" ||
+		pod.Reason != "GetPodCIDRs" || pod.Type != k8s.EventTypeWarning ||
+		pod.Message != "Get PodCIDRs: Annotation not found (network net1)" {
+		t.Fatalf("Unexpected POD event %+v", pod)
+	}
+	if node.Namespace != "default" || node.InvolvedObject.Kind != "Node" ||
+		node.InvolvedObject.Name != "node1" || node.Reason != pod.Reason {
+		t.Fatalf("Unexpected node event %+v", node)
+	}
+
+	// Another reason is not rate-limited
+	newEventRecorder(in).post(ctx, err, "Range sources")
+	if len(events) != 4 || events[2].Reason != "RangeSources" {
+		t.Fatal("Expected 4 events, got", len(events))
+	}
+	// After the interval
+	state := filepath.Join(cacheDir(in), eventStateFile)
+	if err := os.WriteFile(state, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	newEventRecorder(in).post(ctx, err, "Get PodCIDRs")
+	if len(events) != 6 {
+		t.Fatal("Expected 6 events, got", len(events))
+	}
+
+	// Only on ADD
+	os.Setenv("CNI_COMMAND", "DEL")
+	newEventRecorder(in).post(ctx, err, "Delete")
+	// Errors are ignored
+	createEvent = func(ctx context.Context, ev *k8s.Event) error {
+		return fmt.Errorf("Forbidden")
+	}
+	os.Setenv("CNI_COMMAND", "ADD")
+	newEventRecorder(in).post(ctx, err, "Failed "+strings.Repeat("x", 2000))
+	if len(events) != 6 {
+		t.Fatal("Unexpected events", len(events))
+	}
+	var nilRecorder *eventRecorder
+	nilRecorder.post(ctx, err, "Get PodCIDRs")
+}
+
+func TestEventReason(t *testing.T) {
+	tcs := map[string]string{
+		"Get PodCIDRs":                     "GetPodCIDRs",
+		"Requested IP outside node ranges": "RequestedIPOutsideNodeRanges",
+		"":                                 "IPAMFailed",
+	}
+	for msg, expect := range tcs {
+		if r := eventReason(msg); r != expect {
+			t.Fatalf("%s: expected %s, got %s", msg, expect, r)
+		}
+	}
+}
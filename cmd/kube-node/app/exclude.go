@@ -0,0 +1,218 @@
+package app
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+)
+
+// exclusions Addresses that shall not be allocated by the delegate.
+// Exclusions are applied by splitting the range items, so they work
+// for both host-local and the native allocator
+type exclusions struct {
+	first int // Number of addresses excluded at the start of each range
+	last  int // Number of addresses excluded at the end of each range
+	nets  []*net.IPNet
+}
+
+// hostAddresses Returns the addresses on host interfaces. Replaced in
+// unit-test
+var hostAddresses = func() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// newExclusions Returns the exclusions configured in the kube-node ipam
+func newExclusions(ipam *kubeNodeIPAM) (*exclusions, error) {
+	if ipam.ExcludeFirst < 0 || ipam.ExcludeLast < 0 {
+		return nil, fmt.Errorf("Negative excludeFirst or excludeLast")
+	}
+	e := exclusions{first: ipam.ExcludeFirst, last: ipam.ExcludeLast}
+	for _, s := range ipam.Exclude {
+		if strings.Contains(s, "/") {
+			_, ipnet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid exclude [%s]", s)
+			}
+			e.nets = append(e.nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid exclude [%s]", s)
+		}
+		e.addIP(ip)
+	}
+	if ipam.ExcludeHostAddresses {
+		ips, err := hostAddresses()
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			e.addIP(ip)
+		}
+	}
+	return &e, nil
+}
+
+// addIP Excludes a single address
+func (e *exclusions) addIP(ip net.IP) {
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	e.nets = append(e.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+}
+
+// with Returns a copy with the passed addresses excluded as well
+func (e *exclusions) with(ips []net.IP) *exclusions {
+	c := exclusions{first: e.first, last: e.last}
+	c.nets = append(c.nets, e.nets...)
+	for _, ip := range ips {
+		c.addIP(ip)
+	}
+	return &c
+}
+
+// apply Splits the range sets in the ipam so excluded addresses are
+// not allocated. An error is returned if no address is left in a
+// range set
+func (e *exclusions) apply(ipam *hostLocalIPAM) error {
+	if e.first == 0 && e.last == 0 && len(e.nets) == 0 {
+		return nil
+	}
+	var rangeSets []ranges
+	for _, r := range ipam.Ranges {
+		var set ranges
+		for _, item := range r {
+			items, err := e.splitRange(item)
+			if err != nil {
+				return err
+			}
+			set = append(set, items...)
+		}
+		if len(set) == 0 {
+			return fmt.Errorf("All addresses excluded in %s", r[0].Subnet)
+		}
+		rangeSets = append(rangeSets, set)
+	}
+	ipam.Ranges = rangeSets
+	return nil
+}
+
+// splitRange Returns range items covering the addresses in the item
+// except the excluded ones. Defaults are as for host-local
+func (e *exclusions) splitRange(item rangeItem) (ranges, error) {
+	subnet, start, end, err := rangeBounds(item)
+	if err != nil {
+		return nil, err
+	}
+	one := big.NewInt(1)
+	changed := e.first > 0 || e.last > 0
+	start.Add(start, big.NewInt(int64(e.first)))
+	end.Sub(end, big.NewInt(int64(e.last)))
+
+	// Excluded intervals within the subnet, sorted on start
+	type interval struct{ from, to *big.Int }
+	var excl []interval
+	for _, n := range e.nets {
+		if (n.IP.To4() != nil) != (len(subnet.IP) == net.IPv4len) {
+			continue // Other family
+		}
+		if !n.Contains(subnet.IP) && !subnet.Contains(n.IP) {
+			continue
+		}
+		from := ipInt(n.IP.Mask(n.Mask), subnet)
+		nOnes, nBits := n.Mask.Size()
+		to := new(big.Int).Add(from, new(big.Int).Lsh(one, uint(nBits-nOnes)))
+		excl = append(excl, interval{from: from, to: to.Sub(to, one)})
+	}
+	sort.Slice(excl, func(i, j int) bool { return excl[i].from.Cmp(excl[j].from) < 0 })
+
+	toIP := func(n *big.Int) string {
+		ip := make(net.IP, len(subnet.IP))
+		n.FillBytes(ip)
+		return ip.String()
+	}
+	var items ranges
+	add := func(from, to *big.Int) {
+		if from.Cmp(to) > 0 {
+			return
+		}
+		items = append(items, rangeItem{
+			Subnet:     item.Subnet,
+			RangeStart: toIP(from),
+			RangeEnd:   toIP(to),
+			Gateway:    item.Gateway,
+		})
+	}
+	cur := start
+	for _, x := range excl {
+		if x.to.Cmp(cur) < 0 || x.from.Cmp(end) > 0 {
+			continue
+		}
+		changed = true
+		add(cur, new(big.Int).Sub(x.from, one))
+		cur = new(big.Int).Add(x.to, one)
+	}
+	if !changed {
+		return ranges{item}, nil
+	}
+	add(cur, end)
+	return items, nil
+}
+
+// rangeBounds Returns the subnet and the first and last address of a
+// range item. Defaults are as for host-local
+func rangeBounds(item rangeItem) (*net.IPNet, *big.Int, *big.Int, error) {
+	_, subnet, err := net.ParseCIDR(item.Subnet)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	one := big.NewInt(1)
+	network := ipInt(subnet.IP, subnet)
+	ones, bits := subnet.Mask.Size()
+	size := new(big.Int).Lsh(one, uint(bits-ones))
+	start := new(big.Int).Add(network, one)
+	end := new(big.Int).Add(network, size)
+	end.Sub(end, one) // Last address
+	if bits == 32 {
+		end.Sub(end, one) // Broadcast
+	}
+	if item.RangeStart != "" {
+		start = ipInt(net.ParseIP(item.RangeStart), subnet)
+	}
+	if item.RangeEnd != "" {
+		end = ipInt(net.ParseIP(item.RangeEnd), subnet)
+	}
+	return subnet, start, end, nil
+}
+
+// inRange Returns true if the address is within the range item
+func inRange(item rangeItem, ip net.IP) bool {
+	subnet, start, end, err := rangeBounds(item)
+	if err != nil || !subnet.Contains(ip) {
+		return false
+	}
+	n := ipInt(ip, subnet)
+	return n.Cmp(start) >= 0 && n.Cmp(end) <= 0
+}
+
+// ipInt Returns the address as an integer in the family of the subnet
+func ipInt(ip net.IP, subnet *net.IPNet) *big.Int {
+	if ip4 := ip.To4(); ip4 != nil && len(subnet.IP) == net.IPv4len {
+		ip = ip4
+	}
+	return new(big.Int).SetBytes(ip)
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestExclusions(t *testing.T) {
+	hostAddresses = func() ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("10.0.0.1"), net.ParseIP("fd00::1")}, nil
+	}
+	tcases := []struct {
+		name        string
+		subnet      string
+		ipam        kubeNodeIPAM
+		reserved    []string
+		expect      string
+		expectError bool
+	}{
+		{
+			name:   "Nothing excluded",
+			subnet: "10.0.0.0/24",
+			expect: "[10.0.0.0/24]",
+		},
+		{
+			name:   "Other subnet",
+			subnet: "10.0.0.0/24",
+			ipam:   kubeNodeIPAM{Exclude: []string{"10.0.1.5", "fd00::5", "10.0.1.0/24"}},
+			expect: "[10.0.0.0/24]",
+		},
+		{
+			name:   "One",
+			subnet: "10.0.0.0/24",
+			ipam:   kubeNodeIPAM{Exclude: []string{"10.0.0.5"}},
+			expect: "[10.0.0.1-10.0.0.4 10.0.0.6-10.0.0.254]",
+		},
+		{
+			name:   "CIDR",
+			subnet: "10.0.0.0/24",
+			ipam:   kubeNodeIPAM{Exclude: []string{"10.0.0.16/28", "10.0.0.20"}},
+			expect: "[10.0.0.1-10.0.0.15 10.0.0.32-10.0.0.254]",
+		},
+		{
+			name:   "First and last",
+			subnet: "10.0.0.0/24",
+			ipam:   kubeNodeIPAM{ExcludeFirst: 9, ExcludeLast: 4},
+			expect: "[10.0.0.10-10.0.0.250]",
+		},
+		{
+			name:   "Host addresses",
+			subnet: "fd00::/120",
+			ipam:   kubeNodeIPAM{ExcludeHostAddresses: true},
+			expect: "[fd00::2-fd00::ff]",
+		},
+		{
+			name:     "Reserved",
+			subnet:   "fd00::/120",
+			reserved: []string{"fd00::3", "fd00::2"},
+			expect:   "[fd00::1-fd00::1 fd00::4-fd00::ff]",
+		},
+		{
+			name:        "All",
+			subnet:      "10.0.0.0/30",
+			ipam:        kubeNodeIPAM{ExcludeFirst: 1, Exclude: []string{"10.0.0.2"}},
+			expectError: true,
+		},
+		{
+			name:        "Supernet",
+			subnet:      "10.0.0.0/24",
+			ipam:        kubeNodeIPAM{Exclude: []string{"10.0.0.0/16"}},
+			expectError: true,
+		},
+		{
+			name:        "Invalid",
+			subnet:      "10.0.0.0/24",
+			ipam:        kubeNodeIPAM{Exclude: []string{"10.0.0.0/33"}},
+			expectError: true,
+		},
+		{
+			name:        "Negative",
+			subnet:      "10.0.0.0/24",
+			ipam:        kubeNodeIPAM{ExcludeLast: -1},
+			expectError: true,
+		},
+	}
+	for _, tc := range tcases {
+		ipam := &hostLocalIPAM{
+			Type:   "host-local",
+			Ranges: []ranges{[]rangeItem{{Subnet: tc.subnet}}},
+		}
+		e, err := newExclusions(&tc.ipam)
+		if err == nil {
+			var reserved []net.IP
+			for _, s := range tc.reserved {
+				reserved = append(reserved, net.ParseIP(s))
+			}
+			err = e.with(reserved).apply(ipam)
+		}
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+		if err != nil {
+			continue
+		}
+		var items []string
+		for _, item := range ipam.Ranges[0] {
+			if item.RangeStart == "" {
+				items = append(items, item.Subnet)
+			} else {
+				items = append(items, item.RangeStart+"-"+item.RangeEnd)
+			}
+		}
+		if got := fmt.Sprint(items); got != tc.expect {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.expect, got)
+		}
+	}
+}
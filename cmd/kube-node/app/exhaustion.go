@@ -0,0 +1,238 @@
+package app
+
+/*
+   Exhaustion of a range set, reported by host-local or the native
+   allocator, gives a distinct CNI error code. Optionally a node
+   condition and/or a NoSchedule taint is set for the network and
+   family, so cluster autoscalers and operators can react. They are
+   cleared when addresses are available again after an ADD or DEL.
+   The state is kept in a file to avoid API calls on every retry.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// Exhaustion constants
+const (
+	errCodeExhausted    uint = 101 // CNI error code
+	exhaustionStateFile      = "kube-node-exhaustion.json"
+	exhaustionTimeout        = 2 * time.Second
+	exhaustionKeyPrefix      = "kube-node.nordix.org/"
+)
+
+// exhaustionConfig Configures what to set on the own node object when
+// a family is exhausted
+type exhaustionConfig struct {
+	Condition bool `json:"condition,omitempty"`
+	Taint     bool `json:"taint,omitempty"`
+}
+
+// nodeClient Returns a K8s client. Replaced in unit-test
+var nodeClient = func() (kubernetes.Interface, error) {
+	return util.GetClientset()
+}
+
+// isExhausted Returns true if the error is range exhaustion from
+// host-local or the native allocator
+func isExhausted(err error) bool {
+	return errors.Is(err, allocator.ErrExhausted) ||
+		strings.Contains(err.Error(), allocator.ErrExhausted.Error())
+}
+
+// exhaustedFamily Returns "ipv4" or "ipv6" from the range set in an
+// exhaustion error, or "" if unknown
+func exhaustedFamily(err error) string {
+	_, set, ok := strings.Cut(err.Error(), "range set: ")
+	if !ok {
+		return ""
+	}
+	start, _, _ := strings.Cut(set, "-")
+	ip := net.ParseIP(strings.TrimSpace(start))
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return "ipv4"
+	}
+	return "ipv6"
+}
+
+// exhaustionKey Returns the condition type and taint key
+func exhaustionKey(network, family string) string {
+	return exhaustionKeyPrefix + family + "-exhausted-" + network
+}
+
+// markExhausted Sets the configured condition and taint. Errors are
+// logged but ignored
+func markExhausted(ctx context.Context, in *CniConfigIn, nodeName, family string) {
+	cfg := in.IPAM.Exhaustion
+	if cfg == nil || family == "" {
+		return
+	}
+	setExhausted(ctx, in, nodeName, func(state map[string]bool) []string {
+		if state[family] {
+			return nil // Already set
+		}
+		return []string{family}
+	}, true)
+}
+
+// clearExhausted Clears the condition and taint for families with
+// free addresses. The ipam must hold all ranges of the network, see
+// networkIPAM. Errors are logged but ignored
+func clearExhausted(ctx context.Context, in *CniConfigIn, ipam *hostLocalIPAM, nodeName string) {
+	if in.IPAM.Exhaustion == nil || ipam == nil {
+		return
+	}
+	setExhausted(ctx, in, nodeName, func(state map[string]bool) []string {
+		if len(state) == 0 {
+			return nil
+		}
+		nu, err := computeUtilization(in.Name, ipam.DataDir, ipam.Ranges)
+		if err != nil {
+			return nil
+		}
+		var families []string
+		for family, usage := range map[string]*familyUsage{"ipv4": nu.IPv4, "ipv6": nu.IPv6} {
+			if state[family] && usage != nil && usage.Allocated != usage.Total {
+				families = append(families, family)
+			}
+		}
+		return families
+	}, false)
+}
+
+// setExhausted Updates the node and the state for the families
+// returned by fn, under the state file lock
+func setExhausted(
+	ctx context.Context, in *CniConfigIn, nodeName string,
+	fn func(state map[string]bool) []string, exhausted bool) {
+	logger := logr.FromContextOrDiscard(ctx)
+	path := filepath.Join(cacheDir(in), exhaustionStateFile)
+	err := updateStateFile(path, func(data []byte) []byte {
+		state := make(map[string]bool)
+		_ = json.Unmarshal(data, &state)
+		families := fn(state)
+		if len(families) == 0 {
+			return nil
+		}
+		if nodeName == "" {
+			logger.V(1).Info("Exhaustion: node name unknown")
+			return nil
+		}
+		client, err := nodeClient()
+		if err != nil {
+			logger.V(1).Error(err, "Exhaustion: client")
+			return nil
+		}
+		// The invocation context may have expired
+		actx, cancel := context.WithTimeout(context.Background(), exhaustionTimeout)
+		defer cancel()
+		for _, family := range families {
+			err := setNodeExhausted(actx, client, in, nodeName, family, exhausted)
+			if err != nil {
+				logger.V(1).Error(err, "Exhaustion: update node", "family", family)
+				continue
+			}
+			logger.Info("Exhaustion", "family", family, "exhausted", exhausted)
+			if exhausted {
+				state[family] = true
+			} else {
+				delete(state, family)
+			}
+		}
+		data, _ = json.Marshal(state)
+		return data
+	})
+	if err != nil {
+		logger.V(1).Error(err, "Exhaustion state", "file", path)
+	}
+}
+
+// setNodeExhausted Sets the condition and/or taint on the node
+func setNodeExhausted(
+	ctx context.Context, client kubernetes.Interface, in *CniConfigIn,
+	nodeName, family string, exhausted bool) error {
+	cfg := in.IPAM.Exhaustion
+	key := exhaustionKey(in.Name, family)
+	if cfg.Condition {
+		now := meta.Now()
+		cond := k8s.NodeCondition{
+			Type:               k8s.NodeConditionType(key),
+			Status:             k8s.ConditionFalse,
+			Reason:             "AddressesAvailable",
+			Message:            fmt.Sprintf("%s addresses available in network %s", family, in.Name),
+			LastHeartbeatTime:  now,
+			LastTransitionTime: now,
+		}
+		if exhausted {
+			cond.Status = k8s.ConditionTrue
+			cond.Reason = "AddressesExhausted"
+			cond.Message = fmt.Sprintf("No free %s addresses in network %s", family, in.Name)
+		}
+		// Conditions are merged on type
+		patch, _ := json.Marshal(map[string]any{
+			"status": map[string]any{"conditions": []k8s.NodeCondition{cond}},
+		})
+		_, err := client.CoreV1().Nodes().Patch(
+			ctx, nodeName, types.StrategicMergePatchType, patch, meta.PatchOptions{}, "status")
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.Taint {
+		taint := k8s.Taint{Key: key, Effect: k8s.TaintEffectNoSchedule}
+		return setNodeTaint(ctx, client, nodeName, taint, exhausted)
+	}
+	return nil
+}
+
+// setNodeTaint Adds or removes a taint. Taints are a list without a
+// merge key, so the node is updated with a retry on conflict
+func setNodeTaint(
+	ctx context.Context, client kubernetes.Interface, nodeName string,
+	taint k8s.Taint, add bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		n, err := client.CoreV1().Nodes().Get(ctx, nodeName, meta.GetOptions{})
+		if err != nil {
+			return err
+		}
+		var taints []k8s.Taint
+		found := false
+		for _, t := range n.Spec.Taints {
+			if t.MatchTaint(&taint) {
+				found = true
+				continue
+			}
+			taints = append(taints, t)
+		}
+		if found == add {
+			return nil // Nothing to do
+		}
+		if add {
+			now := meta.Now()
+			taint.TimeAdded = &now
+			taints = append(taints, taint)
+		}
+		n.Spec.Taints = taints
+		_, err = client.CoreV1().Nodes().Update(ctx, n, meta.UpdateOptions{})
+		return err
+	})
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestExhaustedError(t *testing.T) {
+	// Native allocator
+	dir := t.TempDir()
+	cfg := &allocator.Config{Name: "net1", DataDir: dir,
+		Ranges: [][]allocator.Range{{{Subnet: "10.0.0.0/30"}}}}
+	var native error
+	for _, id := range []string{"c1", "c2", "c3"} {
+		_, native = allocator.Add(cfg, &allocator.Args{ContainerID: id, IfName: "eth0"})
+	}
+	tcs := []struct {
+		err       error
+		exhausted bool
+		family    string
+	}{
+		{err: native, exhausted: true, family: "ipv4"},
+		{err: fmt.Errorf("failed to allocate for range 1: no IP addresses available in range set: fd00::1-fd00::ff"),
+			exhausted: true, family: "ipv6"},
+		{err: fmt.Errorf("no IP addresses available"), exhausted: true},
+		{err: fmt.Errorf("requested IP address 10.0.0.3 is not available in range set 10.0.0.1-10.0.0.2")},
+	}
+	for _, tc := range tcs {
+		if isExhausted(tc.err) != tc.exhausted {
+			t.Fatalf("%v: expected exhausted=%v", tc.err, tc.exhausted)
+		}
+		if f := exhaustedFamily(tc.err); f != tc.family {
+			t.Fatalf("%v: expected family %q, got %q", tc.err, tc.family, f)
+		}
+	}
+}
+
+func TestExhaustion(t *testing.T) {
+	client := fake.NewSimpleClientset(&k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "node1"},
+		Spec:       k8s.NodeSpec{Taints: []k8s.Taint{{Key: "other", Effect: k8s.TaintEffectNoSchedule}}},
+	})
+	orig := nodeClient
+	defer func() { nodeClient = orig }()
+	nodeClient = func() (kubernetes.Interface, error) { return client, nil }
+
+	ctx := context.TODO()
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:    dir,
+			Exhaustion: &exhaustionConfig{Condition: true, Taint: true},
+		},
+	}
+	key := exhaustionKey("net1", "ipv4")
+	check := func(status k8s.ConditionStatus, tainted bool) {
+		t.Helper()
+		n, _ := client.CoreV1().Nodes().Get(ctx, "node1", meta.GetOptions{})
+		var cond *k8s.NodeCondition
+		for i := range n.Status.Conditions {
+			if string(n.Status.Conditions[i].Type) == key {
+				cond = &n.Status.Conditions[i]
+			}
+		}
+		if cond == nil || cond.Status != status {
+			t.Fatalf("Expected condition %s, got %+v", status, n.Status.Conditions)
+		}
+		found := false
+		for _, taint := range n.Spec.Taints {
+			found = found || taint.Key == key
+		}
+		if found != tainted || len(n.Spec.Taints) == 0 || n.Spec.Taints[0].Key != "other" {
+			t.Fatalf("Unexpected taints %+v", n.Spec.Taints)
+		}
+	}
+
+	markExhausted(ctx, in, "node1", "ipv4")
+	check(k8s.ConditionTrue, true)
+	// Already marked, no API calls
+	n := len(client.Actions())
+	markExhausted(ctx, in, "node1", "ipv4")
+	if len(client.Actions()) != n {
+		t.Fatal("Unexpected API calls", client.Actions()[n:])
+	}
+
+	// 10.0.0.2-10.0.0.6 are allocatable and 10.0.0.6 is reserved
+	o := &outIpam{
+		logger: logr.Discard(),
+		trace:  logr.Discard(),
+		inCfg:  in,
+		ipam: &hostLocalIPAM{
+			DataDir:      dir,
+			Ranges:       []ranges{{{Subnet: "10.0.0.0/29"}}, {{Subnet: "fd00::/120"}}},
+			Reservations: reservations{"default/pod1": {"10.0.0.6"}},
+		},
+		exclude: &exclusions{},
+	}
+	network, err := o.networkIPAM()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &allocator.Config{Name: "net1", DataDir: dir, Ranges: allocatorRanges(network.Ranges)}
+	for _, id := range []string{"c1", "c2", "c3", "c4"} {
+		if _, err := allocator.Add(cfg, &allocator.Args{ContainerID: id, IfName: "eth0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Still exhausted, also after an IPv6-only ADD
+	clearExhausted(ctx, in, network, "node1")
+	check(k8s.ConditionTrue, true)
+	in.IPAM.IPv4NS = []string{"kube-system"}
+	os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE=default")
+	defer os.Unsetenv("CNI_ARGS")
+	if _, err := o.computeOutData(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if network, err = o.networkIPAM(); err != nil {
+		t.Fatal(err)
+	}
+	clearExhausted(ctx, in, network, "node1")
+	check(k8s.ConditionTrue, true)
+	if err := allocator.Del(cfg, &allocator.Args{ContainerID: "c1", IfName: "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	clearExhausted(ctx, in, network, "node1")
+	check(k8s.ConditionFalse, false)
+	// Cleared, no API calls
+	n = len(client.Actions())
+	clearExhausted(ctx, in, network, "node1")
+	if len(client.Actions()) != n {
+		t.Fatal("Unexpected API calls", client.Actions()[n:])
+	}
+}
@@ -0,0 +1,175 @@
+package app
+
+/*
+   lint checks the consistency of node subnets in the cluster. All
+   node objects are read and spec.podCIDRs and the specified
+   annotations are checked. It is intended as a pre-flight and audit
+   tool, and exits with a non-zero code if anything is found.
+*/
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	k8s "k8s.io/api/core/v1"
+)
+
+// LintOptions Options for Lint
+type LintOptions struct {
+	PodCIDRs     bool     // Check spec.podCIDRs
+	Annotations  []string // Annotations to check
+	MinAddresses uint64   // Smaller subnets are reported
+}
+
+// Finding A problem found by Lint
+type Finding struct {
+	Node    string `json:"node"`
+	Source  string `json:"source"`
+	Check   string `json:"check"`
+	Message string `json:"message"`
+}
+
+// Checks reported in Finding
+const (
+	LintMissing = "missing"
+	LintInvalid = "invalid"
+	LintSmall   = "too-small"
+	LintOverlap = "overlap"
+)
+
+// LintMain Parses arguments, runs Lint and prints the findings.
+// Returns the exit code
+func LintMain(ctx context.Context, args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	podCIDRs := fs.Bool("podcidrs", true, "Check spec.podCIDRs")
+	jsonOut := fs.Bool("json", false, "Output in json format")
+	minAddresses := fs.Uint64("min-addresses", 4, "Minimum addresses in a subnet")
+	var annotations stringList
+	fs.Var(&annotations, "annotation", "Annotation to check (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	findings, err := Lint(ctx, util.RealNodeReader(), &LintOptions{
+		PodCIDRs:     *podCIDRs,
+		Annotations:  annotations,
+		MinAddresses: *minAddresses,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 2
+	}
+	if *jsonOut {
+		if findings == nil {
+			findings = []Finding{}
+		}
+		util.EmitJson(findings)
+	} else {
+		for _, f := range findings {
+			fmt.Printf("%s: %s: %s: %s\n", f.Node, f.Source, f.Check, f.Message)
+		}
+	}
+	if len(findings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// stringList A flag that may be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return fmt.Sprint(*s)
+}
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// lintSubnet A subnet on a node, used for overlap checks
+type lintSubnet struct {
+	node   string
+	source string
+	net    *net.IPNet
+}
+
+// Lint Reads all nodes and returns found problems
+func Lint(
+	ctx context.Context, nodeReader util.NodeReader, opt *LintOptions) ([]Finding, error) {
+	nodes, err := nodeReader.GetNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	var findings []Finding
+	var subnets []lintSubnet
+	report := func(node, source, check, format string, a ...any) {
+		findings = append(findings, Finding{
+			Node: node, Source: source, Check: check,
+			Message: fmt.Sprintf(format, a...),
+		})
+	}
+	check := func(n *k8s.Node, source string, cidrs []string, err error) {
+		if err == nil {
+			err = rangesource.Validate(cidrs)
+		}
+		if err != nil {
+			report(n.Name, source, LintInvalid, "%v", err)
+			return
+		}
+		for _, cidr := range cidrs {
+			_, ipnet, _ := net.ParseCIDR(cidr)
+			ones, bits := ipnet.Mask.Size()
+			if bits-ones < 64 && uint64(1)<<(bits-ones) < opt.MinAddresses {
+				report(n.Name, source, LintSmall, "%s has less than %d addresses",
+					cidr, opt.MinAddresses)
+			}
+			subnets = append(subnets, lintSubnet{node: n.Name, source: source, net: ipnet})
+		}
+	}
+
+	for i := range nodes {
+		n := &nodes[i]
+		if opt.PodCIDRs {
+			if n.Spec.PodCIDRs == nil {
+				report(n.Name, rangesource.PodCIDRs, LintMissing, "No spec.podCIDRs found")
+			} else {
+				check(n, rangesource.PodCIDRs, n.Spec.PodCIDRs, nil)
+			}
+		}
+		for _, key := range opt.Annotations {
+			value, ok := n.ObjectMeta.Annotations[key]
+			if !ok {
+				report(n.Name, key, LintMissing, "Annotation not found")
+				continue
+			}
+			cidrs, err := rangesource.ParseCIDRs(value)
+			check(n, key, cidrs, err)
+		}
+	}
+
+	// Overlap check. Subnets are sorted on start address. Since CIDRs
+	// are either nested or disjoint, only following subnets starting
+	// within a subnet can overlap
+	sort.SliceStable(subnets, func(i, j int) bool {
+		return bytes.Compare(subnets[i].net.IP.To16(), subnets[j].net.IP.To16()) < 0
+	})
+	for i, a := range subnets {
+		for _, b := range subnets[i+1:] {
+			if !a.net.Contains(b.net.IP) {
+				break
+			}
+			report(b.node, b.source, LintOverlap, "%s overlaps %s on node %s (%s)",
+				b.net.String(), a.net.String(), a.node, a.source)
+		}
+	}
+	return findings, nil
+}
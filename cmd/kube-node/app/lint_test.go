@@ -0,0 +1,89 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeNodeReader struct {
+	nodes []k8s.Node
+}
+
+func (r *fakeNodeReader) GetNodes(ctx context.Context) ([]k8s.Node, error) {
+	return r.nodes, nil
+}
+func (r *fakeNodeReader) GetNode(ctx context.Context, name string) (*k8s.Node, error) {
+	if n := util.FindNode(ctx, r.nodes, name); n != nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("Node not found")
+}
+
+func lintNode(name string, podCIDRs []string, net1 string) k8s.Node {
+	n := k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: name},
+		Spec:       k8s.NodeSpec{PodCIDRs: podCIDRs},
+	}
+	if net1 != "" {
+		n.ObjectMeta.Annotations = map[string]string{
+			"kube-node.nordix.org/net1": net1,
+		}
+	}
+	return n
+}
+
+func TestLint(t *testing.T) {
+	reader := &fakeNodeReader{
+		nodes: []k8s.Node{
+			lintNode("vm-002", []string{"11.0.1.0/24", "1100:0:0:1::/64"},
+				"172.20.2.0/24,fd00::2:0:0/96"),
+			lintNode("vm-003", []string{"11.0.2.0/24", "1100:0:0:2::/64"},
+				"172.20.3.0/24,fd00::3:0:0/96"),
+		},
+	}
+	opt := &LintOptions{
+		PodCIDRs:     true,
+		Annotations:  []string{"kube-node.nordix.org/net1"},
+		MinAddresses: 4,
+	}
+	findings, err := Lint(context.TODO(), reader, opt)
+	if err != nil {
+		t.Fatal("Lint:", err)
+	}
+	if len(findings) != 0 {
+		t.Fatal("Unexpected findings:", findings)
+	}
+
+	reader.nodes = append(reader.nodes,
+		lintNode("vm-004", nil, ""),
+		lintNode("vm-005", []string{"11.0.5.0/24"}, "172.20.0.0/16"),
+		lintNode("vm-006", []string{"11.0.6.0/24", "11.0.7.0/24"}, "blah"),
+		lintNode("vm-007", []string{"11.0.8.0/31"}, "172.20.2.128/25"),
+		lintNode("vm-008", []string{"172.20.9.0/24"}, "fd00::8:0:0/96"),
+	)
+	findings, err = Lint(context.TODO(), reader, opt)
+	if err != nil {
+		t.Fatal("Lint:", err)
+	}
+	expect := map[string]int{
+		LintMissing: 2, // vm-004
+		LintInvalid: 2, // vm-006
+		LintSmall:   1, // vm-007
+		LintOverlap: 5, // vm-002,003,007,008 in vm-005 and vm-007 in vm-002
+	}
+	count := make(map[string]int)
+	for _, f := range findings {
+		t.Log(f)
+		count[f.Check]++
+	}
+	for k, v := range expect {
+		if count[k] != v {
+			t.Fatalf("Expected %d %s findings, got %d", v, k, count[k])
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package app
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/Nordix/ipam-node-annotation/pkg/metrics"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+)
+
+// Metric names
+const (
+	metricInvocations = "kube_node_invocations_total"
+	metricCache       = "kube_node_cache_requests_total"
+	metricAPILatency  = "kube_node_api_request_duration_seconds"
+	metricAddresses   = "kube_node_addresses"
+)
+
+var metricDescs = []metrics.Desc{
+	{Name: metricInvocations, Type: metrics.Counter,
+		Help: "CNI invocations per network, command and CNI error code (0 on success)"},
+	{Name: metricCache, Type: metrics.Counter,
+		Help: "Cache reads per network and result (hit or miss)"},
+	{Name: metricAPILatency, Type: metrics.Histogram,
+		Help: "K8s API request latency per network and operation"},
+	{Name: metricAddresses, Type: metrics.Gauge,
+		Help: "Addresses per network, range and state (allocated or free)"},
+}
+
+var apiBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type apiObservation struct {
+	op      string
+	seconds float64
+}
+
+// invocationMetrics Collects metrics for one invocation. A nil
+// invocationMetrics is valid and does nothing
+type invocationMetrics struct {
+	file    *metrics.File
+	network string
+	command string
+	cache   string // "hit", "miss" or empty
+	api     []apiObservation
+	dataDir string
+	ranges  [][]allocator.Range
+}
+
+type metricsKey struct{}
+
+// newMetrics Returns metrics for this invocation, or nil if not
+// configured
+func newMetrics(in *CniConfigIn) *invocationMetrics {
+	if in.IPAM == nil || in.IPAM.MetricsFile == "" {
+		return nil
+	}
+	return &invocationMetrics{
+		file:    &metrics.File{Path: in.IPAM.MetricsFile, Descs: metricDescs},
+		network: in.Name,
+		command: os.Getenv("CNI_COMMAND"),
+	}
+}
+
+// withMetrics Returns a context holding the metrics
+func withMetrics(ctx context.Context, m *invocationMetrics) context.Context {
+	return context.WithValue(ctx, metricsKey{}, m)
+}
+
+// metricsFrom Returns the metrics in the context, or nil
+func metricsFrom(ctx context.Context) *invocationMetrics {
+	m, _ := ctx.Value(metricsKey{}).(*invocationMetrics)
+	return m
+}
+
+func (m *invocationMetrics) setCache(hit bool) {
+	if m == nil {
+		return
+	}
+	m.cache = "miss"
+	if hit {
+		m.cache = "hit"
+	}
+}
+
+// observeAPI Records the latency of an API request started at start
+func (m *invocationMetrics) observeAPI(op string, start time.Time) {
+	if m != nil {
+		m.api = append(m.api, apiObservation{op: op, seconds: time.Since(start).Seconds()})
+	}
+}
+
+// setRanges Sets the ranges to report address usage for. The ipam
+// must hold all ranges of the network, see networkIPAM, since the
+// address gauges of the network are replaced
+func (m *invocationMetrics) setRanges(ipam *hostLocalIPAM) {
+	if m != nil && ipam != nil {
+		m.dataDir = ipam.DataDir
+		m.ranges = allocatorRanges(ipam.Ranges)
+	}
+}
+
+// write Updates the metrics file. Errors are logged but ignored, the
+// metrics must not make the invocation fail
+func (m *invocationMetrics) write(ctx context.Context, code uint) {
+	if m == nil || m.command == "VERSION" {
+		return
+	}
+	var usage []allocator.RangeUsage
+	if len(m.ranges) > 0 {
+		usage, _ = allocator.Usage(m.network, m.dataDir, m.ranges)
+	}
+	err := m.file.Update(func(s *metrics.State) {
+		s.Add(metrics.Key(metricInvocations, "network", m.network,
+			"command", m.command, "code", strconv.Itoa(int(code))), 1)
+		if m.cache != "" {
+			s.Add(metrics.Key(metricCache, "network", m.network, "result", m.cache), 1)
+		}
+		for _, o := range m.api {
+			s.Observe(metrics.Key(metricAPILatency, "network", m.network,
+				"operation", o.op), apiBuckets, o.seconds)
+		}
+		if usage != nil {
+			s.DeleteGauges(metrics.Key(metricAddresses, "network", m.network))
+			for _, u := range usage {
+				s.Set(metrics.Key(metricAddresses, "network", m.network,
+					"range", u.Subnet, "state", "allocated"), u.Allocated)
+				s.Set(metrics.Key(metricAddresses, "network", m.network,
+					"range", u.Subnet, "state", "free"), max0(u.Size-u.Allocated))
+			}
+		}
+	})
+	if err != nil {
+		logr.FromContextOrDiscard(ctx).V(1).Error(err, "Write metrics", "file", m.file.Path)
+	}
+}
+
+func max0(v float64) float64 {
+	if v < 0 {
+		return 0
+	}
+	return v
+}
+
+// timedNodeReader Records the latency of node reads
+type timedNodeReader struct {
+	util.NodeReader
+	m *invocationMetrics
+}
+
+// newTimedNodeReader Returns the reader as-is if metrics are not used
+func newTimedNodeReader(r util.NodeReader, m *invocationMetrics) util.NodeReader {
+	if m == nil {
+		return r
+	}
+	return &timedNodeReader{NodeReader: r, m: m}
+}
+
+func (r *timedNodeReader) GetNodes(ctx context.Context) ([]k8s.Node, error) {
+	defer r.m.observeAPI("getNodes", time.Now())
+	return r.NodeReader.GetNodes(ctx)
+}
+
+func (r *timedNodeReader) GetNode(ctx context.Context, name string) (*k8s.Node, error) {
+	defer r.m.observeAPI("getNode", time.Now())
+	return r.NodeReader.GetNode(ctx, name)
+}
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/go-logr/logr"
+)
+
+func TestMetrics(t *testing.T) {
+	if newMetrics(&CniConfigIn{IPAM: &kubeNodeIPAM{}}) != nil {
+		t.Fatal("Metrics without config")
+	}
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{MetricsFile: filepath.Join(dir, "kube-node.prom")},
+	}
+	dataDir := filepath.Join(dir, "data")
+	cfg := &allocator.Config{Name: "net1", DataDir: dataDir,
+		Ranges: [][]allocator.Range{{{Subnet: "10.0.0.0/28"}}}}
+	if _, err := allocator.Add(cfg, &allocator.Args{ContainerID: "c1", IfName: "eth0"}); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("CNI_COMMAND", "ADD")
+	defer os.Unsetenv("CNI_COMMAND")
+
+	ctx := context.TODO()
+	for i := 0; i < 2; i++ {
+		m := newMetrics(in)
+		m.setCache(i == 0)
+		m.observeAPI("getNode", time.Now().Add(-30*time.Millisecond))
+		m.setRanges(&hostLocalIPAM{DataDir: dataDir, Ranges: []ranges{{{Subnet: "10.0.0.0/28"}}}})
+		m.write(ctx, uint(i*11))
+	}
+	data, err := os.ReadFile(in.IPAM.MetricsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{
+		`kube_node_invocations_total{network="net1",command="ADD",code="0"} 1`,
+		`kube_node_invocations_total{network="net1",command="ADD",code="11"} 1`,
+		`kube_node_cache_requests_total{network="net1",result="hit"} 1`,
+		`kube_node_cache_requests_total{network="net1",result="miss"} 1`,
+		`kube_node_api_request_duration_seconds_bucket{network="net1",operation="getNode",le="0.025"} 0`,
+		`kube_node_api_request_duration_seconds_bucket{network="net1",operation="getNode",le="0.05"} 2`,
+		`kube_node_api_request_duration_seconds_count{network="net1",operation="getNode"} 2`,
+		`kube_node_addresses{network="net1",range="10.0.0.0/28",state="allocated"} 1`,
+		`kube_node_addresses{network="net1",range="10.0.0.0/28",state="free"} 12`,
+	}
+	for _, e := range expect {
+		if !strings.Contains(string(data), e+"\n") {
+			t.Fatalf("Expected %s in:\n%s", e, data)
+		}
+	}
+
+	// VERSION is not counted, and nil metrics are valid
+	os.Setenv("CNI_COMMAND", "VERSION")
+	newMetrics(in).write(ctx, 0)
+	var nilMetrics *invocationMetrics
+	nilMetrics.setCache(true)
+	nilMetrics.observeAPI("getNode", time.Now())
+	nilMetrics.write(ctx, 0)
+	if data2, _ := os.ReadFile(in.IPAM.MetricsFile); string(data2) != string(data) {
+		t.Fatalf("Unexpected update:\n%s", data2)
+	}
+}
+
+// TestMetricsIPv6Only The IPv4 gauges must be kept on IPv6-only
+// invocations
+func TestMetricsIPv6Only(t *testing.T) {
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:     dir,
+			IPv4NS:      []string{"kube-system"},
+			MetricsFile: filepath.Join(dir, "kube-node.prom"),
+		},
+	}
+	os.Setenv("CNI_COMMAND", "ADD")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+	o := &outIpam{
+		logger: logr.Discard(),
+		trace:  logr.Discard(),
+		inCfg:  in,
+		ipam: &hostLocalIPAM{
+			DataDir: dir,
+			Ranges:  []ranges{{{Subnet: "10.0.0.0/28"}}, {{Subnet: "fd00::/120"}}},
+		},
+		exclude: &exclusions{},
+	}
+	ctx := context.TODO()
+	for _, ns := range []string{"kube-system", "default"} {
+		os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE="+ns)
+		if _, err := o.computeOutData(ctx); err != nil {
+			t.Fatal(err)
+		}
+		network, err := o.networkIPAM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := newMetrics(in)
+		m.setRanges(network)
+		m.write(ctx, 0)
+	}
+	data, _ := os.ReadFile(in.IPAM.MetricsFile)
+	for _, e := range []string{
+		`kube_node_addresses{network="net1",range="10.0.0.0/28",state="free"} 13`,
+		`kube_node_addresses{network="net1",range="fd00::/120",state="free"} 254`,
+	} {
+		if !strings.Contains(string(data), e+"\n") {
+			t.Fatalf("Expected %s in:\n%s", e, data)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package app
+
+/*
+   Per-namespace IPv4 quotas on a node. Host-local only records the
+   container ID and interface for an address, so allocations are
+   tagged with the K8s namespace in a file in the allocation
+   directory. The IPv4 addresses in use by a namespace are the
+   allocated IPv4 addresses with an owner tagged with the namespace.
+
+   The quota is checked and a slot is reserved under flock(2) on the
+   tag file before the delegate is invoked, so concurrent ADDs can't
+   exceed the quota. The reservation is confirmed after a successful
+   ADD and rolled back on failure. Reservations of crashed invocations
+   expire.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+)
+
+// quotaTagFile Holds the quotaTag per "<containerID>/<ifname>" in
+// the allocation directory
+const quotaTagFile = "kube-node-namespaces.json"
+
+// quotaReserveTimeout Reservations older than this are ignored
+const quotaReserveTimeout = 60 * time.Second
+
+// Policies when an IPv4 quota is exceeded
+const (
+	quotaIPv6Only = "ipv6-only" // Default
+	quotaFail     = "fail"
+)
+
+var errQuotaExceeded = errors.New("IPv4 quota exceeded")
+
+// quotaTag The namespace of a container interface
+type quotaTag struct {
+	Namespace string `json:"namespace"`
+	// Reserved Unix time of a reservation not yet confirmed by an ADD
+	Reserved int64 `json:"reserved,omitempty"`
+}
+
+// quotaTags Tags per "<containerID>/<ifname>"
+type quotaTags map[string]quotaTag
+
+func validateQuotaPolicy(policy string) error {
+	switch policy {
+	case "", quotaIPv6Only, quotaFail:
+		return nil
+	}
+	return fmt.Errorf("Unknown ipv4-quota-policy [%s]", policy)
+}
+
+// quotaTagPath Returns the path to the tag file for the network
+func quotaTagPath(in *CniConfigIn) string {
+	dataDir := in.IPAM.DataDir
+	if dataDir == "" {
+		dataDir = allocator.DefaultDataDir
+	}
+	return filepath.Join(dataDir, in.Name, quotaTagFile)
+}
+
+// quotaOwner Returns the tag key for a container interface
+func quotaOwner(id, ifname string) string {
+	return id + "/" + ifname
+}
+
+// updateQuotaTags Calls fn with the tags and the IPv4 addresses per
+// owner under the lock. The tags are written unless fn returns false.
+// Tags for released addresses and expired reservations are removed
+func updateQuotaTags(in *CniConfigIn, fn func(tags quotaTags, ipv4 map[string]int) bool) error {
+	return updateStateFile(quotaTagPath(in), func(data []byte) []byte {
+		tags := make(quotaTags)
+		_ = json.Unmarshal(data, &tags)
+		owned := make(map[string]bool)
+		ipv4 := make(map[string]int)
+		for addr, owner := range allocator.Owners(in.Name, in.IPAM.DataDir) {
+			key := quotaOwner(owner.ID, owner.IfName)
+			owned[key] = true
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+				ipv4[key]++
+			}
+		}
+		expired := time.Now().Add(-quotaReserveTimeout).Unix()
+		for key, tag := range tags {
+			if !owned[key] && tag.Reserved <= expired {
+				delete(tags, key)
+			}
+		}
+		if !fn(tags, ipv4) {
+			return nil
+		}
+		data, _ = json.Marshal(tags)
+		return data
+	})
+}
+
+// reserveQuota Reserves an IPv4 address for the container interface
+// in the namespace. An error wrapping errQuotaExceeded is returned if
+// the quota is reached. Nothing is done if the namespace has no quota
+func reserveQuota(in *CniConfigIn, ns, id, ifname string) error {
+	quota, ok := in.IPAM.IPv4Quotas[ns]
+	if !ok || ns == "" {
+		return nil
+	}
+	self := quotaOwner(id, ifname)
+	var exceeded error
+	err := updateQuotaTags(in, func(tags quotaTags, ipv4 map[string]int) bool {
+		n := 0
+		for key, tag := range tags {
+			if key == self || tag.Namespace != ns {
+				continue
+			}
+			if ipv4[key] > 0 {
+				n += ipv4[key]
+			} else if tag.Reserved != 0 {
+				n++ // Not yet allocated
+			}
+		}
+		if n >= quota {
+			// The namespace is not in the message, it may be redacted
+			exceeded = fmt.Errorf("%w; %d of %d used", errQuotaExceeded, n, quota)
+			return false
+		}
+		tags[self] = quotaTag{Namespace: ns, Reserved: time.Now().Unix()}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return exceeded
+}
+
+// releaseQuota Removes a reservation for the container interface, e.g.
+// if the delegate failed
+func releaseQuota(in *CniConfigIn, id, ifname string) error {
+	if len(in.IPAM.IPv4Quotas) == 0 {
+		return nil
+	}
+	self := quotaOwner(id, ifname)
+	return updateQuotaTags(in, func(tags quotaTags, ipv4 map[string]int) bool {
+		if tags[self].Reserved == 0 {
+			return false
+		}
+		delete(tags, self)
+		return true
+	})
+}
+
+// tagNamespace Tags the container interface with the namespace, and
+// confirms a reservation, on ADD and removes the tag on DEL. Nothing is
+// done if no quotas are configured
+func tagNamespace(in *CniConfigIn, ns, id, ifname string) error {
+	if len(in.IPAM.IPv4Quotas) == 0 {
+		return nil
+	}
+	cmd := os.Getenv("CNI_COMMAND")
+	if cmd != "ADD" && cmd != "DEL" {
+		return nil
+	}
+	self := quotaOwner(id, ifname)
+	return updateQuotaTags(in, func(tags quotaTags, ipv4 map[string]int) bool {
+		if cmd == "ADD" {
+			tags[self] = quotaTag{Namespace: ns}
+		} else {
+			delete(tags, self)
+		}
+		return true
+	})
+}
@@ -0,0 +1,172 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/go-logr/logr"
+)
+
+func TestQuota(t *testing.T) {
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:    dir,
+			IPv4Quotas: map[string]int{"team-a": 1},
+		},
+	}
+	dualStack := []ranges{
+		[]rangeItem{{Subnet: "10.0.0.0/24"}},
+		[]rangeItem{{Subnet: "fd00::/120"}},
+	}
+	cfg := &allocator.Config{Name: "net1", DataDir: dir, Ranges: allocatorRanges(dualStack)}
+	setEnv := func(cmd, ns, id string) {
+		os.Setenv("CNI_COMMAND", cmd)
+		os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE="+ns)
+		os.Setenv("CNI_CONTAINERID", id)
+		os.Setenv("CNI_IFNAME", "eth0")
+	}
+	defer func() {
+		for _, e := range []string{"CNI_COMMAND", "CNI_ARGS", "CNI_CONTAINERID", "CNI_IFNAME"} {
+			os.Unsetenv(e)
+		}
+	}()
+	// run Adds or deletes the container interface and updates the tags
+	run := func(cmd, ns, id string) {
+		t.Helper()
+		setEnv(cmd, ns, id)
+		args := &allocator.Args{ContainerID: id, IfName: "eth0"}
+		var err error
+		if cmd == "ADD" {
+			_, err = allocator.Add(cfg, args)
+		} else {
+			err = allocator.Del(cfg, args)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tagNamespace(in, ns, id, "eth0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// compute Returns the number of range sets or an error
+	compute := func(ns, id string, sets []ranges) (int, error) {
+		setEnv("ADD", ns, id)
+		o := &outIpam{
+			logger:  logr.Discard(),
+			trace:   logr.Discard(),
+			inCfg:   in,
+			ipam:    &hostLocalIPAM{Type: "host-local", Ranges: sets},
+			exclude: &exclusions{},
+		}
+		out, err := o.computeOutData(context.TODO())
+		if err != nil {
+			return 0, err
+		}
+		return len(out.IPAM.Ranges), nil
+	}
+
+	run("ADD", "team-a", "c1")
+	run("ADD", "team-b", "c2")
+	tcases := []struct {
+		name   string
+		ns     string
+		id     string
+		policy string
+		sets   []ranges
+		expect int
+		err    bool
+	}{
+		{name: "Exceeded", ns: "team-a", id: "c3", sets: dualStack, expect: 1},
+		{name: "Retry", ns: "team-a", id: "c1", sets: dualStack, expect: 2},
+		{name: "No quota", ns: "team-b", id: "c3", sets: dualStack, expect: 2},
+		{name: "Fail", ns: "team-a", id: "c3", policy: quotaFail, sets: dualStack, err: true},
+		{name: "IPv4 only", ns: "team-a", id: "c3", sets: dualStack[:1], err: true},
+	}
+	for _, tc := range tcases {
+		in.IPAM.IPv4QuotaPolicy = tc.policy
+		n, err := compute(tc.ns, tc.id, tc.sets)
+		if tc.err {
+			if !errors.Is(err, errQuotaExceeded) {
+				t.Fatalf("%s: expected quota error, got %v", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if n != tc.expect {
+			t.Fatalf("%s: expected %d range sets, got %d", tc.name, tc.expect, n)
+		}
+	}
+
+	// The quota is available again after DEL
+	in.IPAM.IPv4QuotaPolicy = ""
+	run("DEL", "team-a", "c1")
+	if n, err := compute("team-a", "c3", dualStack); err != nil || n != 2 {
+		t.Fatalf("After DEL: expected 2 range sets, got %d %v", n, err)
+	}
+	if err := validateQuotaPolicy("ipv4-only"); err == nil {
+		t.Fatal("Invalid policy accepted")
+	}
+}
+
+func TestQuotaConcurrent(t *testing.T) {
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:    t.TempDir(),
+			IPv4Quotas: map[string]int{"team-a": 3},
+		},
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var reserved []string
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			err := reserveQuota(in, "team-a", id, "eth0")
+			if err != nil && !errors.Is(err, errQuotaExceeded) {
+				t.Error(err)
+			}
+			if err == nil {
+				mu.Lock()
+				reserved = append(reserved, id)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("c%d", i))
+	}
+	wg.Wait()
+	if len(reserved) != 3 {
+		t.Fatalf("Expected 3 reservations, got %v", reserved)
+	}
+	// A rolled back reservation frees the slot
+	if err := releaseQuota(in, reserved[0], "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := reserveQuota(in, "team-a", "c100", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	// Expired reservations are removed
+	path := quotaTagPath(in)
+	data, _ := os.ReadFile(path)
+	tags := make(quotaTags)
+	_ = json.Unmarshal(data, &tags)
+	for key, tag := range tags {
+		tag.Reserved -= int64(quotaReserveTimeout.Seconds())
+		tags[key] = tag
+	}
+	data, _ = json.Marshal(tags)
+	_ = os.WriteFile(path, data, 0644)
+	if err := reserveQuota(in, "team-a", "c101", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,175 @@
+package app
+
+/*
+   Reservations give PODs a fixed address on each node. They are
+   declared in an annotation on the node object, or in a ConfigMap
+   where the keys are node names, as a json object mapping
+   "namespace/name" to addresses. The name may be a pattern as for
+   path.Match, e.g.:
+
+     {"ingress/ingress-*": ["10.0.0.10","fd00::10"]}
+
+   Reserved addresses are excluded from dynamic allocation, see
+   exclude.go.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// reservations Maps "namespace/name" patterns to addresses
+type reservations map[string][]string
+
+// parseReservations Parses and validates reservations in json format
+func parseReservations(s string) (reservations, error) {
+	var r reservations
+	if err := json.Unmarshal([]byte(s), &r); err != nil {
+		return nil, err
+	}
+	for key, ips := range r {
+		ns, name, ok := strings.Cut(key, "/")
+		if !ok || ns == "" || name == "" {
+			return nil, fmt.Errorf("Invalid reservation key [%s]", key)
+		}
+		if _, err := path.Match(key, key); err != nil {
+			return nil, fmt.Errorf("Invalid reservation key [%s]", key)
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				return nil, fmt.Errorf("Invalid reserved IP [%s] for %s", ip, key)
+			}
+		}
+	}
+	return r, nil
+}
+
+// lookup Returns the addresses reserved for a POD. An exact match
+// takes precedence, otherwise the first matching pattern in sorted
+// order is used
+func (r reservations) lookup(namespace, name string) []net.IP {
+	if namespace == "" || name == "" {
+		return nil
+	}
+	pod := namespace + "/" + name
+	if ips, ok := r[pod]; ok {
+		return parseIPs(ips)
+	}
+	keys := make([]string, 0, len(r))
+	for key := range r {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if match, _ := path.Match(key, pod); match {
+			return parseIPs(r[key])
+		}
+	}
+	return nil
+}
+
+// errReserved Requested address reserved for another POD
+var errReserved = errors.New("Requested IP reserved for another POD")
+
+// checkRequested Returns an error wrapping errReserved if any of the
+// requested addresses is reserved, but not for the POD
+func (r reservations) checkRequested(namespace, name string, ips []net.IP) error {
+	own := r.lookup(namespace, name)
+	reserved := r.all()
+	for _, ip := range ips {
+		if containsIP(reserved, ip) && !containsIP(own, ip) {
+			return fmt.Errorf("%w [%s]", errReserved, ip)
+		}
+	}
+	return nil
+}
+
+// all Returns all reserved addresses
+func (r reservations) all() []net.IP {
+	var ips []net.IP
+	for _, v := range r {
+		ips = append(ips, parseIPs(v)...)
+	}
+	return ips
+}
+
+func parseIPs(items []string) []net.IP {
+	var ips []net.IP
+	for _, s := range items {
+		if ip := net.ParseIP(s); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// getConfigMapData Returns the data in a ConfigMap. Replaced in unit-test
+var getConfigMapData = func(ctx context.Context, namespace, name string) (map[string]string, error) {
+	cm, err := util.GetApi(ctx).ConfigMaps(namespace).Get(ctx, name, meta.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// readReservations Reads reservations for the own node from the
+// annotation and the ConfigMap ("namespace/name"), if configured.
+// Entries in the annotation takes precedence
+func readReservations(
+	ctx context.Context, ipam *kubeNodeIPAM, node *rangesource.OwnNode) (reservations, error) {
+	if ipam.ReservationsAnnotation == "" && ipam.ReservationsConfigMap == "" {
+		return nil, nil
+	}
+	n, err := node.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r := make(reservations)
+	if cmName := ipam.ReservationsConfigMap; cmName != "" {
+		ns, name, ok := strings.Cut(cmName, "/")
+		if !ok {
+			return nil, fmt.Errorf("Invalid ConfigMap [%s]", cmName)
+		}
+		start := time.Now()
+		data, err := getConfigMapData(ctx, ns, name)
+		metricsFrom(ctx).observeAPI("getConfigMap", start)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := data[n.ObjectMeta.Name]; ok {
+			cm, err := parseReservations(s)
+			if err != nil {
+				return nil, fmt.Errorf("ConfigMap %s: %w", cmName, err)
+			}
+			for k, v := range cm {
+				r[k] = v
+			}
+		}
+	}
+	if key := ipam.ReservationsAnnotation; key != "" {
+		if s, ok := n.ObjectMeta.Annotations[key]; ok {
+			a, err := parseReservations(s)
+			if err != nil {
+				return nil, fmt.Errorf("Annotation %s: %w", key, err)
+			}
+			for k, v := range a {
+				r[k] = v
+			}
+		}
+	}
+	if len(r) == 0 {
+		return nil, nil
+	}
+	return r, nil
+}
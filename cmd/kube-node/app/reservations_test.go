@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReservations(t *testing.T) {
+	r, err := parseReservations(`{
+  "ingress/ingress-*": ["10.0.0.10","fd00::10"],
+  "ingress/ingress-special": ["10.0.0.11"],
+  "monitoring/agent-?????": ["10.0.0.12"]
+}`)
+	if err != nil {
+		t.Fatal("parseReservations:", err)
+	}
+	tcases := []struct {
+		ns, name string
+		expect   string
+	}{
+		{ns: "ingress", name: "ingress-abcde", expect: "[10.0.0.10 fd00::10]"},
+		{ns: "ingress", name: "ingress-special", expect: "[10.0.0.11]"},
+		{ns: "monitoring", name: "agent-x7k2p", expect: "[10.0.0.12]"},
+		{ns: "monitoring", name: "agent-x7k2", expect: "[]"},
+		{ns: "default", name: "ingress-abcde", expect: "[]"},
+		{ns: "", name: "", expect: "[]"},
+	}
+	for _, tc := range tcases {
+		if got := fmt.Sprint(r.lookup(tc.ns, tc.name)); got != tc.expect {
+			t.Fatalf("%s/%s: expected %s, got %s", tc.ns, tc.name, tc.expect, got)
+		}
+	}
+	if n := len(r.all()); n != 4 {
+		t.Fatal("Expected 4 reserved addresses, got", n)
+	}
+
+	invalid := []string{
+		`{"ingress": ["10.0.0.10"]}`,
+		`{"ingress/[": ["10.0.0.10"]}`,
+		`{"ingress/x": ["10.0.0.1000"]}`,
+		`["10.0.0.10"]`,
+	}
+	for _, s := range invalid {
+		if _, err := parseReservations(s); err == nil {
+			t.Fatalf("%s: Expected error but got OK", s)
+		}
+	}
+}
+
+func TestReadReservations(t *testing.T) {
+	node := k8s.Node{
+		ObjectMeta: meta.ObjectMeta{
+			Name: "vm-002",
+			Annotations: map[string]string{
+				"example.com/reservations": `{"ingress/ingress-*": ["10.0.0.10"]}`,
+			},
+		},
+	}
+	getConfigMapData = func(ctx context.Context, namespace, name string) (map[string]string, error) {
+		if namespace != "kube-system" || name != "reservations" {
+			return nil, fmt.Errorf("Not found")
+		}
+		return map[string]string{
+			"vm-002": `{"ingress/ingress-*": ["10.0.0.20"], "kube-system/dns": ["10.0.0.21"]}`,
+		}, nil
+	}
+	os.Setenv("NODE_NAME", "vm-002")
+	defer os.Unsetenv("NODE_NAME")
+	ipam := &kubeNodeIPAM{
+		ReservationsAnnotation: "example.com/reservations",
+		ReservationsConfigMap:  "kube-system/reservations",
+	}
+	r, err := readReservations(context.TODO(), ipam,
+		rangesource.NewOwnNode(&fakeNodeReader{nodes: []k8s.Node{node}}))
+	if err != nil {
+		t.Fatal("readReservations:", err)
+	}
+	// The annotation takes precedence
+	if got := fmt.Sprint(r.lookup("ingress", "ingress-1")); got != "[10.0.0.10]" {
+		t.Fatal("Unexpected", got)
+	}
+	if got := fmt.Sprint(r.lookup("kube-system", "dns")); got != "[10.0.0.21]" {
+		t.Fatal("Unexpected", got)
+	}
+}
+
+func TestReservedRequested(t *testing.T) {
+	os.Setenv("CNI_COMMAND", "ADD")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+	tcases := []struct {
+		pod      string
+		ip       string
+		reserved bool
+	}{
+		{pod: "default/pod1", ip: "10.0.0.10", reserved: true},
+		{pod: "ingress/ingress-a", ip: "10.0.0.10"},
+		{pod: "default/pod1", ip: "10.0.0.20"},
+	}
+	for _, tc := range tcases {
+		ns, name, _ := strings.Cut(tc.pod, "/")
+		os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE="+ns+";K8S_POD_NAME="+name)
+		o := &outIpam{
+			logger: logr.Discard(),
+			trace:  logr.Discard(),
+			inCfg:  &CniConfigIn{IPAM: &kubeNodeIPAM{}},
+			ipam: &hostLocalIPAM{
+				Type:         "host-local",
+				Ranges:       []ranges{{{Subnet: "10.0.0.0/24"}}},
+				Reservations: reservations{"ingress/ingress-*": {"10.0.0.10"}},
+			},
+			ips:     []net.IP{net.ParseIP(tc.ip)},
+			exclude: &exclusions{},
+		}
+		_, err := o.computeOutData(context.TODO())
+		if errors.Is(err, errReserved) != tc.reserved {
+			t.Fatalf("%s %s: expected reserved=%v, got %v", tc.pod, tc.ip, tc.reserved, err)
+		}
+	}
+}
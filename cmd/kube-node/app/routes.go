@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+)
+
+// parseRoutes Parses and validates routes in json format, e.g.:
+//
+//	[{"dst":"192.168.0.0/16","gw":"10.0.0.1"}]
+func parseRoutes(s string) ([]*cnitypes.Route, error) {
+	var routes []*cnitypes.Route
+	if err := json.Unmarshal([]byte(s), &routes); err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		if r == nil || r.Dst.IP == nil {
+			return nil, fmt.Errorf("Route without dst")
+		}
+		r.Dst.IP = r.Dst.IP.Mask(r.Dst.Mask)
+		if r.GW != nil && isIPv4(r.GW) != isIPv4(r.Dst.IP) {
+			return nil, fmt.Errorf("Route %s via %s, family mismatch", r.Dst.String(), r.GW)
+		}
+	}
+	return routes, nil
+}
+
+// nodeNetconf Routes and DNS in the netconf annotation, e.g.:
+//
+//	{"routes":[{"dst":"192.168.0.0/16","gw":"10.0.0.1"}],
+//	 "dns":{"nameservers":["10.0.0.53"],"search":["example.com"]}}
+type nodeNetconf struct {
+	Routes json.RawMessage `json:"routes,omitempty"`
+	DNS    *cnitypes.DNS   `json:"dns,omitempty"`
+}
+
+// readNetconf Reads extra routes and DNS from the routes and netconf
+// annotations in the own node object, if configured. Routes from both
+// annotations are used
+func readNetconf(
+	ctx context.Context, ipam *kubeNodeIPAM,
+	node *rangesource.OwnNode) ([]*cnitypes.Route, *cnitypes.DNS, error) {
+	if ipam.RoutesAnnotation == "" && ipam.NetconfAnnotation == "" {
+		return nil, nil, nil
+	}
+	n, err := node.Get(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var routes []*cnitypes.Route
+	var dns *cnitypes.DNS
+	if key := ipam.RoutesAnnotation; key != "" {
+		if s, ok := n.ObjectMeta.Annotations[key]; ok {
+			if routes, err = parseRoutes(s); err != nil {
+				return nil, nil, fmt.Errorf("Annotation %s: %w", key, err)
+			}
+		}
+	}
+	if key := ipam.NetconfAnnotation; key != "" {
+		if s, ok := n.ObjectMeta.Annotations[key]; ok {
+			var nc nodeNetconf
+			if err := json.Unmarshal([]byte(s), &nc); err != nil {
+				return nil, nil, fmt.Errorf("Annotation %s: %w", key, err)
+			}
+			if nc.Routes != nil {
+				r, err := parseRoutes(string(nc.Routes))
+				if err != nil {
+					return nil, nil, fmt.Errorf("Annotation %s: %w", key, err)
+				}
+				routes = append(routes, r...)
+			}
+			if nc.DNS != nil {
+				if err := validateDNS(nc.DNS); err != nil {
+					return nil, nil, fmt.Errorf("Annotation %s: %w", key, err)
+				}
+				dns = nc.DNS
+			}
+		}
+	}
+	return routes, dns, nil
+}
+
+// defaultRoutes Returns a default route per family in the range sets,
+// via the gateway of the range. The gateway defaults to the first
+// address in the subnet, as for host-local
+func defaultRoutes(rangeSets []ranges) []*cnitypes.Route {
+	var routes []*cnitypes.Route
+	for _, r := range rangeSets {
+		_, subnet, err := net.ParseCIDR(r[0].Subnet)
+		if err != nil {
+			continue
+		}
+		gw := net.ParseIP(r[0].Gateway)
+		if gw == nil {
+			gw = make(net.IP, len(subnet.IP))
+			copy(gw, subnet.IP)
+			gw[len(gw)-1]++
+		}
+		dst := "::/0"
+		if isIPv4(subnet.IP) {
+			dst = "0.0.0.0/0"
+		}
+		_, ipnet, _ := net.ParseCIDR(dst)
+		routes = append(routes, &cnitypes.Route{Dst: *ipnet, GW: gw})
+	}
+	return routes
+}
+
+// familyRoutes Returns the routes with a family present in the range sets
+func familyRoutes(routes []*cnitypes.Route, rangeSets []ranges) []*cnitypes.Route {
+	var v4, v6 bool
+	for _, r := range rangeSets {
+		if ip, _, err := net.ParseCIDR(r[0].Subnet); err == nil {
+			if isIPv4(ip) {
+				v4 = true
+			} else {
+				v6 = true
+			}
+		}
+	}
+	var out []*cnitypes.Route
+	for _, r := range routes {
+		if isIPv4(r.Dst.IP) && v4 || !isIPv4(r.Dst.IP) && v6 {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func isIPv4(ip net.IP) bool {
+	return ip.To4() != nil
+}
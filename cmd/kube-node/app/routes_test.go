@@ -0,0 +1,132 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rangesource"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseRoutes(t *testing.T) {
+	tcases := []struct {
+		name        string
+		routes      string
+		expect      int
+		expectError bool
+	}{
+		{name: "Empty", routes: `[]`},
+		{name: "Routes", routes: `[{"dst":"192.168.0.0/16","gw":"10.0.0.1"},{"dst":"fd01::/64"}]`, expect: 2},
+		{name: "Family mismatch", routes: `[{"dst":"192.168.0.0/16","gw":"fd00::1"}]`, expectError: true},
+		{name: "No dst", routes: `[{"gw":"10.0.0.1"}]`, expectError: true},
+		{name: "Invalid dst", routes: `[{"dst":"192.168.0.0/33"}]`, expectError: true},
+		{name: "Invalid gw", routes: `[{"dst":"192.168.0.0/16","gw":"10.0.0.300"}]`, expectError: true},
+		{name: "Not a list", routes: `{"dst":"192.168.0.0/16"}`, expectError: true},
+	}
+	for _, tc := range tcases {
+		routes, err := parseRoutes(tc.routes)
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+		if err == nil && len(routes) != tc.expect {
+			t.Fatalf("%s: expected %d routes, got %d", tc.name, tc.expect, len(routes))
+		}
+	}
+}
+
+func TestRoutesInOutData(t *testing.T) {
+	extra, err := parseRoutes(`[{"dst":"0.0.0.0/0","gw":"10.0.0.254"},{"dst":"192.168.0.0/16","gw":"10.0.0.254"},{"dst":"fd01::/64","gw":"fd00::254"}]`)
+	if err != nil {
+		t.Fatal("parseRoutes:", err)
+	}
+	tcases := []struct {
+		name             string
+		isDefaultGateway bool
+		ipv4NS           []string
+		expect           string
+	}{
+		{
+			name:   "Extra routes",
+			expect: "[0.0.0.0/0 via 10.0.0.254 192.168.0.0/16 via 10.0.0.254 fd01::/64 via fd00::254]",
+		},
+		{
+			name:             "Default gateway",
+			isDefaultGateway: true,
+			expect:           "[0.0.0.0/0 via 10.0.0.1 ::/0 via fd00::1 192.168.0.0/16 via 10.0.0.254 fd01::/64 via fd00::254]",
+		},
+		{
+			name:             "IPv6 only",
+			isDefaultGateway: true,
+			ipv4NS:           []string{"kube-system"},
+			expect:           "[::/0 via fd00::1 fd01::/64 via fd00::254]",
+		},
+	}
+	os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE=default")
+	defer os.Unsetenv("CNI_ARGS")
+	for _, tc := range tcases {
+		o := &outIpam{
+			logger: logr.Discard(),
+			trace:  logr.Discard(),
+			inCfg: &CniConfigIn{
+				IsDefaultGateway: tc.isDefaultGateway,
+				IPAM:             &kubeNodeIPAM{IPv4NS: tc.ipv4NS},
+			},
+			ipam: &hostLocalIPAM{
+				Type: "host-local",
+				Ranges: []ranges{
+					[]rangeItem{{Subnet: "10.0.0.0/24"}},
+					[]rangeItem{{Subnet: "fd00::/120"}},
+				},
+				Routes: extra,
+			},
+			exclude: &exclusions{},
+		}
+		out, err := o.computeOutData(context.TODO())
+		if err != nil {
+			t.Fatalf("%s: computeOutData: %v", tc.name, err)
+		}
+		var routes []string
+		for _, r := range out.IPAM.Routes {
+			routes = append(routes, r.Dst.String()+" via "+r.GW.String())
+		}
+		if got := fmt.Sprint(routes); got != tc.expect {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.expect, got)
+		}
+	}
+}
+
+func TestReadNetconf(t *testing.T) {
+	annotations := map[string]string{
+		"example.com/routes":  `[{"dst":"192.168.0.0/16","gw":"10.0.0.254"}]`,
+		"example.com/netconf": `{"routes":[{"dst":"fd01::/64"}],"dns":{"nameservers":["10.0.0.53"]}}`,
+		"example.com/invalid": `{"dns":{"nameservers":["10.0.0.530"]}}`,
+	}
+	node := k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "vm-002", Annotations: annotations},
+	}
+	os.Setenv("NODE_NAME", "vm-002")
+	defer os.Unsetenv("NODE_NAME")
+	ownNode := rangesource.NewOwnNode(&fakeNodeReader{nodes: []k8s.Node{node}})
+	ipam := &kubeNodeIPAM{
+		RoutesAnnotation:  "example.com/routes",
+		NetconfAnnotation: "example.com/netconf",
+	}
+	routes, dns, err := readNetconf(context.TODO(), ipam, ownNode)
+	if err != nil {
+		t.Fatal("readNetconf:", err)
+	}
+	if len(routes) != 2 || dns == nil || dns.Nameservers[0] != "10.0.0.53" {
+		t.Fatal("Unexpected", routes, dns)
+	}
+	ipam = &kubeNodeIPAM{NetconfAnnotation: "example.com/invalid"}
+	if _, _, err := readNetconf(context.TODO(), ipam, ownNode); err == nil {
+		t.Fatal("Expected error")
+	}
+}
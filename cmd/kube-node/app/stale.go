@@ -0,0 +1,166 @@
+package app
+
+/*
+   Allocations in a persistent dataDir survive reboots and
+   re-creation of the node object. The boot ID and node UID are
+   recorded in a state file in the allocation directory, and on a
+   mismatch the allocations are quarantined or cleared.
+
+   A cache written before a reboot is not used. A cache written for
+   another node object is detected when the node is read on a cache
+   miss, and on ADD with a cache hit by reading the node UID at most
+   once per interval, if it was known when the cache was written.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/go-logr/logr"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// stateFile Holds the dataDirState in the allocation directory
+const stateFile = "kube-node-state.json"
+
+// Policies for stale allocations
+const (
+	staleQuarantine = "quarantine" // Default
+	staleClear      = "clear"
+	staleKeep       = "keep"
+)
+
+const tmpfsMagic = 0x01021994
+
+// Node UID checks on a cache hit
+const (
+	nodeUIDStateFile = "kube-node-nodeuid.json"
+	nodeUIDInterval  = 300 // Seconds
+	nodeUIDTimeout   = 2 * time.Second
+)
+
+// dataDirState The boot and node the allocations were made for
+type dataDirState struct {
+	BootID  string `json:"bootID,omitempty"`
+	NodeUID string `json:"nodeUID,omitempty"`
+}
+
+func validateStalePolicy(policy string) error {
+	switch policy {
+	case "", staleQuarantine, staleClear, staleKeep:
+		return nil
+	}
+	return fmt.Errorf("Unknown staleAllocations [%s]", policy)
+}
+
+// checkStale Quarantines or clears the allocations if they were made
+// before a reboot or for another node object, and records the current
+// state. Nothing is done if no state has been recorded. This is done
+// under the same lock as used by host-local
+func checkStale(ctx context.Context, in *CniConfigIn, current dataDirState) error {
+	logger := logr.FromContextOrDiscard(ctx)
+	store, err := allocator.NewStore(in.Name, in.IPAM.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if !isTmpfs(store.Dir()) {
+		logger.Info("Warning: dataDir is not on tmpfs", "dir", store.Dir())
+	}
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+
+	path := filepath.Join(store.Dir(), stateFile)
+	var old dataDirState
+	if data, err := os.ReadFile(path); err == nil {
+		_ = json.Unmarshal(data, &old)
+	}
+	stale := old.BootID != "" && current.BootID != "" && old.BootID != current.BootID ||
+		old.NodeUID != "" && current.NodeUID != "" && old.NodeUID != current.NodeUID
+	if stale {
+		policy := in.IPAM.StaleAllocations
+		logger.Info(
+			"Stale allocations", "dir", store.Dir(), "policy", policy,
+			"old", old, "current", current)
+		switch policy {
+		case "", staleQuarantine:
+			to := store.Dir() + ".stale-" + strconv.FormatInt(time.Now().Unix(), 10)
+			err = store.Quarantine(to)
+		case staleClear:
+			err = store.Quarantine("")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if current.NodeUID == "" {
+		current.NodeUID = old.NodeUID
+	}
+	data, err := json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// checkNodeUID Returns an error if the cache was written for another
+// node object, e.g. if the node was re-created with the same name. The
+// node is read at most once per nodeUIDInterval, the time of the last
+// check is kept in a state file. If the node can't be read the cache
+// is assumed to be valid
+func (o *outIpam) checkNodeUID(ctx context.Context) error {
+	if o.meta.NodeUID == "" || o.meta.NodeName == "" {
+		return nil
+	}
+	var mismatch error
+	path := filepath.Join(cacheDir(o.inCfg), nodeUIDStateFile)
+	err := updateStateFile(path, func(data []byte) []byte {
+		var last struct {
+			Time int64 `json:"time"`
+		}
+		_ = json.Unmarshal(data, &last)
+		now := time.Now().Unix()
+		if now-last.Time < nodeUIDInterval {
+			return nil
+		}
+		last.Time = now
+		data, _ = json.Marshal(&last)
+		client, err := nodeClient()
+		if err != nil {
+			o.logger.V(1).Error(err, "Check node UID")
+			return data
+		}
+		ctx, cancel := context.WithTimeout(ctx, nodeUIDTimeout)
+		defer cancel()
+		node, err := client.CoreV1().Nodes().Get(ctx, o.meta.NodeName, meta.GetOptions{})
+		if err != nil {
+			o.logger.V(1).Error(err, "Check node UID", "node", o.meta.NodeName)
+			return data
+		}
+		if uid := string(node.ObjectMeta.UID); uid != o.meta.NodeUID {
+			mismatch = fmt.Errorf("Cache written for another node object")
+		}
+		return data
+	})
+	if err != nil {
+		o.logger.V(1).Error(err, "Node UID state", "file", path)
+	}
+	return mismatch
+}
+
+func isTmpfs(dir string) bool {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return false
+	}
+	return st.Type == tmpfsMagic
+}
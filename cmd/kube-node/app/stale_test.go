@@ -0,0 +1,110 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckStale(t *testing.T) {
+	ctx := context.TODO()
+	dataDir := t.TempDir()
+	dir := filepath.Join(dataDir, "net1")
+	allocate := func() {
+		_ = os.MkdirAll(dir, 0755)
+		_ = os.WriteFile(filepath.Join(dir, "10.0.0.2"), []byte("c1\r\neth0"), 0644)
+	}
+	allocated := func() bool {
+		_, err := os.Stat(filepath.Join(dir, "10.0.0.2"))
+		return err == nil
+	}
+	in := &CniConfigIn{Name: "net1", IPAM: &kubeNodeIPAM{DataDir: dataDir}}
+
+	tcases := []struct {
+		name      string
+		policy    string
+		state     dataDirState
+		allocated bool
+	}{
+		{name: "First", state: dataDirState{BootID: "b1"}, allocated: true},
+		{name: "Same boot", state: dataDirState{BootID: "b1", NodeUID: "u1"}, allocated: true},
+		{name: "Unknown node", state: dataDirState{BootID: "b1"}, allocated: true},
+		{name: "Reboot", state: dataDirState{BootID: "b2"}},
+		{name: "Node re-created", state: dataDirState{BootID: "b2", NodeUID: "u2"}},
+		{name: "Clear", policy: staleClear, state: dataDirState{BootID: "b3"}},
+		{name: "Keep", policy: staleKeep, state: dataDirState{BootID: "b4"}, allocated: true},
+	}
+	for _, tc := range tcases {
+		allocate()
+		in.IPAM.StaleAllocations = tc.policy
+		if err := checkStale(ctx, in, tc.state); err != nil {
+			t.Fatalf("%s: checkStale: %v", tc.name, err)
+		}
+		if allocated() != tc.allocated {
+			t.Fatalf("%s: expected allocated %v", tc.name, tc.allocated)
+		}
+	}
+	// Quarantined allocations are kept
+	quarantined, _ := filepath.Glob(filepath.Join(dataDir, "net1.stale-*", "10.0.0.2"))
+	if len(quarantined) == 0 {
+		t.Fatal("No quarantined allocations")
+	}
+	if err := validateStalePolicy("remove"); err == nil {
+		t.Fatal("Expected error")
+	}
+}
+
+func TestCheckNodeUID(t *testing.T) {
+	ctx := context.TODO()
+	client := fake.NewSimpleClientset(&k8s.Node{
+		ObjectMeta: meta.ObjectMeta{Name: "node1", UID: "uid2"},
+	})
+	orig := nodeClient
+	defer func() { nodeClient = orig }()
+	nodeClient = func() (kubernetes.Interface, error) { return client, nil }
+
+	in := &CniConfigIn{Name: "net1", IPAM: &kubeNodeIPAM{CacheDir: t.TempDir()}}
+	o := newOutIpam(ctx, in)
+	if err := o.createHostLocalIPAM(ctx, []string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	tcases := []struct {
+		name    string
+		uid     string
+		node    string
+		invalid bool
+	}{
+		{name: "Re-created", uid: "uid1", node: "node1", invalid: true},
+		{name: "Same", uid: "uid2", node: "node1"},
+		{name: "Unknown UID", node: "node1"},
+		{name: "Not found", uid: "uid1", node: "node2"},
+	}
+	for _, tc := range tcases {
+		o.meta.NodeUID, o.meta.NodeName = tc.uid, tc.node
+		o.writeCache(ctx)
+		c := newOutIpam(ctx, in)
+		if err := c.readCache(ctx); err != nil {
+			t.Fatalf("%s: readCache: %v", tc.name, err)
+		}
+		os.Remove(filepath.Join(cacheDir(in), nodeUIDStateFile))
+		if err := c.checkNodeUID(ctx); (err != nil) != tc.invalid {
+			t.Fatalf("%s: expected invalid=%v, got %v", tc.name, tc.invalid, err)
+		}
+	}
+
+	// The node is not read again within the interval
+	o.meta.NodeUID, o.meta.NodeName = "uid1", "node1"
+	gets := len(client.Actions())
+	if err := o.checkNodeUID(ctx); err != nil {
+		t.Fatalf("Within interval: %v", err)
+	}
+	if n := len(client.Actions()); n != gets {
+		t.Fatalf("Within interval: expected no API calls, got %d", n-gets)
+	}
+}
@@ -0,0 +1,159 @@
+package app
+
+/*
+   The address utilization per family is written in an annotation on
+   the own node object after ADD and DEL. Updates are debounced; they
+   are skipped if the values are unchanged or if the last update was
+   made within the interval, so the annotation may lag until the next
+   ADD or DEL. A merge patch is used that only affects the annotation,
+   so there are no conflicts with other writers.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Utilization defaults
+const (
+	utilizationStateFile       = "kube-node-utilization.json"
+	defaultUtilizationInterval = 30 // Seconds
+	utilizationTimeout         = 2 * time.Second
+)
+
+// familyUsage Counts for one address family
+type familyUsage struct {
+	Allocated json.Number `json:"allocated"`
+	Total     json.Number `json:"total"`
+}
+
+// nodeUtilization The annotation value
+type nodeUtilization struct {
+	Network string       `json:"network"`
+	IPv4    *familyUsage `json:"ipv4,omitempty"`
+	IPv6    *familyUsage `json:"ipv6,omitempty"`
+}
+
+// utilizationState The last update, stored in a state file
+type utilizationState struct {
+	Time  int64  `json:"time"`
+	Value string `json:"value"`
+}
+
+// patchNode Applies a merge patch to a node. Replaced in unit-test
+var patchNode = func(ctx context.Context, name string, patch []byte) error {
+	// Not util.GetApi(), it exits on failure
+	clientset, err := util.GetClientset()
+	if err != nil {
+		return err
+	}
+	_, err = clientset.CoreV1().Nodes().Patch(
+		ctx, name, types.MergePatchType, patch, meta.PatchOptions{})
+	return err
+}
+
+// computeUtilization Returns the utilization per family in the ranges
+func computeUtilization(network, dataDir string, ranges []ranges) (*nodeUtilization, error) {
+	usage, err := allocator.Usage(network, dataDir, allocatorRanges(ranges))
+	if err != nil {
+		return nil, err
+	}
+	var alloc, total [2]float64
+	var found [2]bool
+	for _, u := range usage {
+		ip, _, err := net.ParseCIDR(u.Subnet)
+		if err != nil {
+			return nil, err
+		}
+		f := 1
+		if ip.To4() != nil {
+			f = 0
+		}
+		found[f] = true
+		alloc[f] += u.Allocated
+		total[f] += u.Size
+	}
+	num := func(v float64) json.Number {
+		return json.Number(strconv.FormatFloat(v, 'f', 0, 64))
+	}
+	nu := &nodeUtilization{Network: network}
+	if found[0] {
+		nu.IPv4 = &familyUsage{Allocated: num(alloc[0]), Total: num(total[0])}
+	}
+	if found[1] {
+		nu.IPv6 = &familyUsage{Allocated: num(alloc[1]), Total: num(total[1])}
+	}
+	return nu, nil
+}
+
+// ownNodeName Returns the node name from the cache, or $NODE_NAME
+func ownNodeName(cached string) string {
+	if cached != "" {
+		return cached
+	}
+	return os.Getenv("NODE_NAME")
+}
+
+// updateUtilization Writes the utilization annotation on the own node
+// if configured. The ipam must hold all ranges of the network, see
+// networkIPAM. Errors are logged but ignored
+func updateUtilization(ctx context.Context, in *CniConfigIn, ipam *hostLocalIPAM, nodeName string) {
+	cmd := os.Getenv("CNI_COMMAND")
+	if in.IPAM.UtilizationAnnotation == "" || ipam == nil || (cmd != "ADD" && cmd != "DEL") {
+		return
+	}
+	logger := logr.FromContextOrDiscard(ctx)
+	if nodeName == "" {
+		logger.V(1).Info("Utilization: node name unknown")
+		return
+	}
+	nu, err := computeUtilization(in.Name, ipam.DataDir, ipam.Ranges)
+	if err != nil {
+		logger.V(1).Error(err, "Utilization")
+		return
+	}
+	value, _ := json.Marshal(nu)
+	interval := in.IPAM.UtilizationInterval
+	if interval == 0 {
+		interval = defaultUtilizationInterval
+	}
+	path := filepath.Join(cacheDir(in), utilizationStateFile)
+	err = updateStateFile(path, func(data []byte) []byte {
+		var last utilizationState
+		_ = json.Unmarshal(data, &last)
+		now := time.Now().Unix()
+		if last.Value == string(value) || now-last.Time < int64(interval) {
+			return nil
+		}
+		patch, _ := json.Marshal(map[string]any{
+			"metadata": map[string]any{
+				"annotations": map[string]string{
+					in.IPAM.UtilizationAnnotation: string(value),
+				},
+			},
+		})
+		pctx, cancel := context.WithTimeout(ctx, utilizationTimeout)
+		defer cancel()
+		if err := patchNode(pctx, nodeName, patch); err != nil {
+			logger.V(1).Error(err, "Utilization patch", "node", nodeName)
+			return nil
+		}
+		logger.V(2).Info("Utilization updated", "node", nodeName, "value", nu)
+		data, _ = json.Marshal(&utilizationState{Time: now, Value: string(value)})
+		return data
+	})
+	if err != nil {
+		logger.V(1).Error(err, "Utilization state", "file", path)
+	}
+}
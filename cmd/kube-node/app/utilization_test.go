@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/allocator"
+	"github.com/go-logr/logr"
+)
+
+func TestUtilization(t *testing.T) {
+	type patch struct {
+		node  string
+		value nodeUtilization
+	}
+	var patches []patch
+	orig := patchNode
+	defer func() { patchNode = orig }()
+	patchNode = func(ctx context.Context, name string, data []byte) error {
+		var p struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			t.Fatal("Invalid patch", err)
+		}
+		var nu nodeUtilization
+		if err := json.Unmarshal([]byte(p.Metadata.Annotations["example.com/utilization"]), &nu); err != nil {
+			t.Fatal("Invalid annotation", err)
+		}
+		patches = append(patches, patch{node: name, value: nu})
+		return nil
+	}
+
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:               dir,
+			UtilizationAnnotation: "example.com/utilization",
+		},
+	}
+	out := &cniConfigOut{
+		Name: "net1",
+		IPAM: &hostLocalIPAM{
+			DataDir: dir,
+			Ranges:  []ranges{{{Subnet: "10.0.0.0/28"}}, {{Subnet: "fd00::/120"}}},
+		},
+	}
+	cfg := &allocator.Config{Name: "net1", DataDir: dir, Ranges: allocatorRanges(out.IPAM.Ranges)}
+	add := func(id string) {
+		if _, err := allocator.Add(cfg, &allocator.Args{ContainerID: id, IfName: "eth0"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("c1")
+	os.Setenv("CNI_COMMAND", "ADD")
+	defer os.Unsetenv("CNI_COMMAND")
+
+	ctx := context.TODO()
+	updateUtilization(ctx, in, out.IPAM, "node1")
+	add("c2")
+	updateUtilization(ctx, in, out.IPAM, "node1") // Within the interval
+	if len(patches) != 1 {
+		t.Fatal("Expected 1 patch, got", len(patches))
+	}
+	p := patches[0]
+	if p.node != "node1" || p.value.Network != "net1" ||
+		p.value.IPv4.Allocated != "1" || p.value.IPv4.Total != "13" ||
+		p.value.IPv6.Allocated != "1" || p.value.IPv6.Total != "254" {
+		t.Fatalf("Unexpected patch %+v %+v %+v", p, p.value.IPv4, p.value.IPv6)
+	}
+
+	// After the interval
+	state := filepath.Join(cacheDir(in), utilizationStateFile)
+	var s utilizationState
+	data, _ := os.ReadFile(state)
+	_ = json.Unmarshal(data, &s)
+	s.Time -= defaultUtilizationInterval
+	data, _ = json.Marshal(&s)
+	_ = os.WriteFile(state, data, 0644)
+	updateUtilization(ctx, in, out.IPAM, "node1")
+	if len(patches) != 2 || patches[1].value.IPv4.Allocated != "2" {
+		t.Fatal("Expected an update", patches)
+	}
+	// Unchanged values are not written
+	data, _ = os.ReadFile(state)
+	_ = json.Unmarshal(data, &s)
+	s.Time -= defaultUtilizationInterval
+	data, _ = json.Marshal(&s)
+	_ = os.WriteFile(state, data, 0644)
+	os.Setenv("CNI_COMMAND", "DEL")
+	updateUtilization(ctx, in, out.IPAM, "node1")
+	// Not on CHECK
+	os.Setenv("CNI_COMMAND", "CHECK")
+	updateUtilization(ctx, in, out.IPAM, "node1")
+	if len(patches) != 2 {
+		t.Fatal("Unexpected update", patches)
+	}
+}
+
+// TestUtilizationIPv6Only The usage must not depend on the POD, e.g.
+// IPv6-only PODs or the own reservation
+func TestUtilizationIPv6Only(t *testing.T) {
+	var values []string
+	orig := patchNode
+	defer func() { patchNode = orig }()
+	patchNode = func(ctx context.Context, name string, data []byte) error {
+		var p struct {
+			Metadata struct {
+				Annotations map[string]string `json:"annotations"`
+			} `json:"metadata"`
+		}
+		_ = json.Unmarshal(data, &p)
+		values = append(values, p.Metadata.Annotations["example.com/utilization"])
+		return nil
+	}
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_ARGS")
+
+	dir := t.TempDir()
+	in := &CniConfigIn{
+		Name: "net1",
+		IPAM: &kubeNodeIPAM{
+			DataDir:               dir,
+			IPv4NS:                []string{"dual"},
+			UtilizationAnnotation: "example.com/utilization",
+			UtilizationInterval:   -1, // Always update
+		},
+	}
+	o := &outIpam{
+		logger: logr.Discard(),
+		trace:  logr.Discard(),
+		inCfg:  in,
+		ipam: &hostLocalIPAM{
+			Type:    "host-local",
+			DataDir: dir,
+			Ranges:  []ranges{{{Subnet: "10.0.0.0/28"}}, {{Subnet: "fd00::/120"}}},
+			Reservations: reservations{
+				"dual/pod1":   {"10.0.0.10"},
+				"single/pod2": {"fd00::10"},
+			},
+		},
+		exclude: &exclusions{},
+	}
+	ctx := context.TODO()
+	for _, pod := range []string{"dual/pod1", "single/pod2"} {
+		ns, name, _ := strings.Cut(pod, "/")
+		os.Setenv("CNI_COMMAND", "ADD")
+		os.Setenv("CNI_ARGS", "K8S_POD_NAMESPACE="+ns+";K8S_POD_NAME="+name)
+		o.ips = o.ipam.Reservations.lookup(ns, name)
+		if _, err := o.computeOutData(ctx); err != nil {
+			t.Fatal(err)
+		}
+		network, err := o.networkIPAM()
+		if err != nil {
+			t.Fatal(err)
+		}
+		updateUtilization(ctx, in, network, "node1")
+	}
+	expect := `{"network":"net1","ipv4":{"allocated":0,"total":12},"ipv6":{"allocated":0,"total":253}}`
+	if len(values) != 1 || values[0] != expect {
+		t.Fatalf("Expected one update %s, got %v", expect, values)
+	}
+}
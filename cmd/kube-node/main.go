@@ -18,10 +18,13 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/Nordix/ipam-node-annotation/pkg/log"
 	"github.com/Nordix/ipam-node-annotation/cmd/kube-node/app"
+	"github.com/Nordix/ipam-node-annotation/pkg/log"
+	"go.uber.org/zap"
 )
 
 var (
@@ -35,6 +38,17 @@ func main() {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+	if flag.Arg(0) == "agent" {
+		ctx, cancel := signal.NotifyContext(
+			context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+		os.Exit(app.AgentMain(ctx, flag.Args()[1:]))
+	}
+	if flag.Arg(0) == "lint" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		os.Exit(app.LintMain(ctx, flag.Args()[1:]))
+	}
 
 	// The execution may be blocked by a slow response from the API
 	// server, so we set a timeout
@@ -43,9 +57,36 @@ func main() {
 
 	in := app.ReadCniConfigIn(ctx) // (will exit on failure)
 
-	if in.IPAM != nil && in.IPAM.LogFile != "" && in.IPAM.LogFile != "stdout" {
-		zlogger, err := log.ZapLogger(in.IPAM.LogFile, in.IPAM.LogLevel)
-		if err == nil {
+	if in.IPAM != nil {
+		// The environment overrides the config, for debugging on a
+		// single node
+		if v, ok := os.LookupEnv("KUBE_NODE_LOGLEVEL"); ok {
+			in.IPAM.LogLevel = v
+		}
+		if v, ok := os.LookupEnv("KUBE_NODE_LOGFILE"); ok {
+			in.IPAM.LogFile = v
+		}
+		// Stdout is used for the CNI result and can't be used for logging
+		sinks := in.IPAM.LogSinks
+		switch in.IPAM.LogFile {
+		case "", "stdout":
+		case "stderr":
+			sinks = append(sinks, log.Sink{Type: log.SinkStderr})
+		default:
+			sinks = append(sinks, log.Sink{Type: log.SinkFile, Path: in.IPAM.LogFile})
+		}
+		if len(sinks) > 0 {
+			zlogger, err := log.NewFallbackLogger(&log.Config{
+				Sinks:     sinks,
+				Level:     in.IPAM.LogLevel,
+				Encoding:  in.IPAM.LogEncoding,
+				Levels:    in.IPAM.LogLevels,
+				Redaction: in.IPAM.LogRedaction,
+			})
+			if err != nil {
+				// Reported through the configured sinks
+				zlogger.Error("Log config", zap.Error(err))
+			}
 			ctx = log.NewContext(ctx, zlogger)
 		}
 	}
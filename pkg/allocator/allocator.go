@@ -0,0 +1,336 @@
+package allocator
+
+/*
+   allocator is an in-process address allocator that can be used
+   instead of the host-local IPAM CNI-plugin. The on-disk format and
+   the allocation strategy are the same as for host-local, so it's
+   safe to switch back and forth.
+*/
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// ErrExhausted Returned (wrapped) when a range set has no free
+// addresses. The message is the same as from host-local
+var ErrExhausted = errors.New("no IP addresses available")
+
+// Config Corresponds to a host-local ipam config
+type Config struct {
+	Name    string    // The network name
+	DataDir string    // DefaultDataDir if empty
+	Ranges  [][]Range // Range sets
+	// Strategy Allocation strategy, Sequential if empty
+	Strategy string
+}
+
+// Args Per-invocation arguments
+type Args struct {
+	ContainerID string
+	IfName      string
+	IPs         []net.IP // Requested addresses (optional)
+	// POD identity, used by the PodHash strategy
+	PodNamespace string
+	PodName      string
+}
+
+// rangeSet A parsed range set
+type rangeSet []*ipRange
+
+func parseRangeSets(ranges [][]Range) ([]rangeSet, error) {
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("No Ranges")
+	}
+	var sets []rangeSet
+	for _, rs := range ranges {
+		if len(rs) == 0 {
+			return nil, fmt.Errorf("Empty range set")
+		}
+		var set rangeSet
+		for _, r := range rs {
+			ir, err := parseRange(r)
+			if err != nil {
+				return nil, err
+			}
+			set = append(set, ir)
+		}
+		sets = append(sets, set)
+	}
+	return sets, nil
+}
+
+func (s rangeSet) rangeFor(ip net.IP) *ipRange {
+	for _, r := range s {
+		if r.contains(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s rangeSet) String() string {
+	var items []string
+	for _, r := range s {
+		items = append(items, r.start.String()+"-"+r.end.String())
+	}
+	return strings.Join(items, ",")
+}
+
+// Add Allocates one address from each range set
+func Add(cfg *Config, args *Args) (*current.Result, error) {
+	sets, err := parseRangeSets(cfg.Ranges)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateStrategy(cfg.Strategy); err != nil {
+		return nil, err
+	}
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return nil, err
+	}
+	defer store.Unlock()
+
+	requested := make(map[string]net.IP)
+	for _, ip := range args.IPs {
+		requested[ip.String()] = ip
+	}
+
+	result := &current.Result{CNIVersion: current.ImplementedSpecVersion}
+	for idx, set := range sets {
+		var reqIP net.IP
+		for k, ip := range requested {
+			if set.rangeFor(ip) != nil {
+				reqIP = ip
+				delete(requested, k)
+				break
+			}
+		}
+		ipConf, err := get(store, set, strconv.Itoa(idx), cfg.Strategy, args, reqIP)
+		if err != nil {
+			// Deallocate already allocated addresses
+			if len(result.IPs) > 0 {
+				_ = store.ReleaseByID(args.ContainerID, args.IfName)
+			}
+			return nil, fmt.Errorf("failed to allocate for range %d: %w", idx, err)
+		}
+		result.IPs = append(result.IPs, ipConf)
+	}
+
+	if len(requested) != 0 {
+		_ = store.ReleaseByID(args.ContainerID, args.IfName)
+		var ips []string
+		for k := range requested {
+			ips = append(ips, k)
+		}
+		return nil, fmt.Errorf(
+			"failed to allocate all requested IPs: %s", strings.Join(ips, " "))
+	}
+	return result, nil
+}
+
+// Del Releases all addresses allocated for the container interface
+func Del(cfg *Config, args *Args) error {
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	return store.ReleaseByID(args.ContainerID, args.IfName)
+}
+
+// GC Releases all addresses not allocated for one of the valid
+// container interfaces. Addresses in files written by old host-local
+// versions are kept if the container ID is valid
+func GC(cfg *Config, valid []Args) error {
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	keep := make(map[Owner]bool)
+	for _, a := range valid {
+		id := strings.TrimSpace(a.ContainerID)
+		keep[Owner{ID: id, IfName: a.IfName}] = true
+		keep[Owner{ID: id}] = true
+	}
+	for _, owner := range Owners(cfg.Name, cfg.DataDir) {
+		if keep[owner] {
+			continue
+		}
+		if err := store.ReleaseByID(owner.ID, owner.IfName); err != nil {
+			return err
+		}
+		keep[owner] = true // Released
+	}
+	return nil
+}
+
+// Status Returns an error if addresses can't be allocated, i.e. if
+// the ranges are invalid or the store can't be locked
+func Status(cfg *Config) error {
+	if _, err := parseRangeSets(cfg.Ranges); err != nil {
+		return err
+	}
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	return store.Unlock()
+}
+
+// Check Returns an error if no address is allocated for the
+// container interface
+func Check(cfg *Config, args *Args) error {
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if err := store.Lock(); err != nil {
+		return err
+	}
+	defer store.Unlock()
+	if len(store.GetByID(args.ContainerID, args.IfName)) == 0 {
+		return fmt.Errorf(
+			"Failed to find address added by container %v", args.ContainerID)
+	}
+	return nil
+}
+
+// get Allocates an address from a range set. The store must be locked
+func get(
+	store *Store, set rangeSet, rangeID, strategy string, args *Args,
+	reqIP net.IP) (*current.IPConfig, error) {
+	if reqIP != nil {
+		reqIP = canonicalize(reqIP)
+		r := set.rangeFor(reqIP)
+		if reqIP.Equal(r.gw) {
+			return nil, fmt.Errorf("requested ip %s is subnet's gateway", reqIP)
+		}
+		reserved, err := store.Reserve(args.ContainerID, args.IfName, reqIP, rangeID)
+		if err != nil {
+			return nil, err
+		}
+		if !reserved {
+			return nil, fmt.Errorf(
+				"requested IP address %s is not available in range set %s", reqIP, set)
+		}
+		return ipConfig(reqIP, r), nil
+	}
+
+	// Duplicate allocation is not allowed by the CNI spec
+	for _, ip := range store.GetByID(args.ContainerID, args.IfName) {
+		if set.rangeFor(ip) != nil {
+			return nil, fmt.Errorf(
+				"%s has been allocated to %s, duplicate allocation is not allowed",
+				ip, args.ContainerID)
+		}
+	}
+
+	next, err := candidates(store, set, rangeID, strategy, args)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		ip, r := next()
+		if ip == nil {
+			break
+		}
+		reserved, err := store.Reserve(args.ContainerID, args.IfName, ip, rangeID)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return ipConfig(ip, r), nil
+		}
+	}
+	return nil, fmt.Errorf("%w in range set: %s", ErrExhausted, set)
+}
+
+func ipConfig(ip net.IP, r *ipRange) *current.IPConfig {
+	return &current.IPConfig{
+		Address: net.IPNet{IP: ip, Mask: r.subnet.Mask},
+		Gateway: r.gw,
+	}
+}
+
+// iter Iterates over a range set round-robin, starting after the last
+// reserved address, as host-local does
+type iter struct {
+	set     rangeSet
+	idx     int
+	cur     net.IP
+	startIP net.IP
+}
+
+func newIter(store *Store, set rangeSet, rangeID string) *iter {
+	it := iter{set: set}
+	// If the last reserved address can't be read we just lose
+	// round-robin this time
+	if last, err := store.LastReservedIP(rangeID); err == nil && last != nil {
+		for i, r := range set {
+			if r.contains(last) {
+				it.idx = i
+				it.cur = canonicalize(last)
+				return &it
+			}
+		}
+	}
+	it.startIP = set[0].start
+	return &it
+}
+
+// next Returns the next address and its range, or nil when all
+// addresses have been tried. The gateway is skipped
+func (it *iter) next() (net.IP, *ipRange) {
+	r := it.set[it.idx]
+	if it.cur == nil {
+		it.cur = r.start
+		it.startIP = it.cur
+		if it.cur.Equal(r.gw) {
+			return it.next()
+		}
+		return it.cur, r
+	}
+
+	if it.cur.Equal(r.end) {
+		it.idx = (it.idx + 1) % len(it.set)
+		r = it.set[it.idx]
+		it.cur = r.start
+	} else {
+		it.cur = nextIP(it.cur)
+	}
+
+	if it.startIP == nil {
+		it.startIP = it.cur
+	} else if it.cur.Equal(it.startIP) {
+		return nil, nil
+	}
+	if it.cur.Equal(r.gw) {
+		return it.next()
+	}
+	return it.cur, r
+}
@@ -0,0 +1,299 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func testConfig(t *testing.T, ranges ...[]Range) *Config {
+	return &Config{
+		Name:    "net1",
+		DataDir: t.TempDir(),
+		Ranges:  ranges,
+	}
+}
+
+func addresses(t *testing.T, cfg *Config, id string) []string {
+	res, err := Add(cfg, &Args{ContainerID: id, IfName: "eth0"})
+	if err != nil {
+		t.Fatalf("Add %s: %v", id, err)
+	}
+	var addrs []string
+	for _, ip := range res.IPs {
+		addrs = append(addrs, ip.Address.String())
+	}
+	return addrs
+}
+
+func TestAllocate(t *testing.T) {
+	cfg := testConfig(t,
+		[]Range{{Subnet: "10.0.0.0/29"}},
+		[]Range{{Subnet: "fd00::/120"}},
+	)
+	a := addresses(t, cfg, "c1")
+	if fmt.Sprint(a) != "[10.0.0.2/29 fd00::2/120]" {
+		t.Fatal("Unexpected", a)
+	}
+
+	// host-local format
+	dir := filepath.Join(cfg.DataDir, cfg.Name)
+	data, err := os.ReadFile(filepath.Join(dir, "10.0.0.2"))
+	if err != nil || string(data) != "c1\r\neth0" {
+		t.Fatalf("Address file %q %v", data, err)
+	}
+	data, err = os.ReadFile(filepath.Join(dir, "last_reserved_ip.1"))
+	if err != nil || string(data) != "fd00::2" {
+		t.Fatalf("Last reserved file %q %v", data, err)
+	}
+
+	// Duplicate
+	if _, err := Add(cfg, &Args{ContainerID: "c1", IfName: "eth0"}); err == nil {
+		t.Fatal("Duplicate allocation allowed")
+	}
+	if err := Check(cfg, &Args{ContainerID: "c1", IfName: "eth0"}); err != nil {
+		t.Fatal("Check:", err)
+	}
+
+	// Round-robin and exhaustion. 10.0.0.2-10.0.0.6 are allocatable
+	for i := 2; i <= 5; i++ {
+		_ = addresses(t, cfg, fmt.Sprintf("c%d", i))
+	}
+	if _, err := Add(cfg, &Args{ContainerID: "c6", IfName: "eth0"}); !errors.Is(err, ErrExhausted) {
+		t.Fatal("Expected exhaustion", err)
+	}
+	// An IPv6 address must not be left on failure
+	if err := Check(cfg, &Args{ContainerID: "c6", IfName: "eth0"}); err == nil {
+		t.Fatal("Address left after failure")
+	}
+
+	if err := Del(cfg, &Args{ContainerID: "c2", IfName: "eth0"}); err != nil {
+		t.Fatal("Del:", err)
+	}
+	if err := Check(cfg, &Args{ContainerID: "c2", IfName: "eth0"}); err == nil {
+		t.Fatal("Check after Del")
+	}
+	if a := addresses(t, cfg, "c6"); a[0] != "10.0.0.3/29" {
+		t.Fatal("Expected the released address", a)
+	}
+}
+
+func TestRequested(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	args := &Args{ContainerID: "c1", IfName: "eth0", IPs: []net.IP{net.ParseIP("10.0.0.100")}}
+	res, err := Add(cfg, args)
+	if err != nil {
+		t.Fatal("Add:", err)
+	}
+	if res.IPs[0].Address.IP.String() != "10.0.0.100" {
+		t.Fatal("Unexpected", res.IPs[0])
+	}
+	tcases := []string{"10.0.0.100", "10.0.0.1", "10.0.1.1"}
+	for _, ip := range tcases {
+		args := &Args{ContainerID: "c2", IfName: "eth0", IPs: []net.IP{net.ParseIP(ip)}}
+		if _, err := Add(cfg, args); err == nil {
+			t.Fatalf("%s: expected error", ip)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	tcases := []struct {
+		name        string
+		r           Range
+		expect      string
+		expectError bool
+	}{
+		{name: "Default", r: Range{Subnet: "10.0.0.0/24"}, expect: "10.0.0.2/24"},
+		{name: "Start", r: Range{Subnet: "10.0.0.0/24", RangeStart: "10.0.0.10"}, expect: "10.0.0.10/24"},
+		{name: "Gateway", r: Range{Subnet: "10.0.0.0/24", Gateway: "10.0.0.254"}, expect: "10.0.0.1/24"},
+		{name: "Host bits", r: Range{Subnet: "10.0.0.1/24"}, expectError: true},
+		{name: "Too small", r: Range{Subnet: "10.0.0.0/31"}, expectError: true},
+		{name: "Start outside", r: Range{Subnet: "10.0.0.0/24", RangeStart: "10.0.1.10"}, expectError: true},
+		{name: "Start after end", r: Range{Subnet: "10.0.0.0/24", RangeStart: "10.0.0.10", RangeEnd: "10.0.0.5"}, expectError: true},
+	}
+	for _, tc := range tcases {
+		cfg := testConfig(t, []Range{tc.r})
+		res, err := Add(cfg, &Args{ContainerID: "c1", IfName: "eth0"})
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+		if err == nil && res.IPs[0].Address.String() != tc.expect {
+			t.Fatalf("%s: expected %s, got %s", tc.name, tc.expect, res.IPs[0].Address.String())
+		}
+	}
+}
+
+// TestHostLocalCompat Files written by old host-local versions
+// contain only the container ID
+func TestHostLocalCompat(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	dir := filepath.Join(cfg.DataDir, cfg.Name)
+	_ = os.MkdirAll(dir, 0755)
+	_ = os.WriteFile(filepath.Join(dir, "10.0.0.2"), []byte("old"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "last_reserved_ip.0"), []byte("10.0.0.2"), 0644)
+	if a := addresses(t, cfg, "c1"); a[0] != "10.0.0.3/24" {
+		t.Fatal("Unexpected", a)
+	}
+	if err := Del(cfg, &Args{ContainerID: "old", IfName: "eth0"}); err != nil {
+		t.Fatal("Del:", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "10.0.0.2")); !os.IsNotExist(err) {
+		t.Fatal("Old format file not released")
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	cfg := testConfig(t,
+		[]Range{{Subnet: "10.0.0.0/24"}},
+		[]Range{{Subnet: "fd00::/120"}},
+	)
+	const n = 100
+	var wg sync.WaitGroup
+	results := make([][]string, n)
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := Add(cfg, &Args{ContainerID: fmt.Sprintf("c%d", i), IfName: "eth0"})
+			errs[i] = err
+			if err == nil {
+				for _, ip := range res.IPs {
+					results[i] = append(results[i], ip.Address.IP.String())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]int)
+	for i := 0; i < n; i++ {
+		if errs[i] != nil {
+			t.Fatalf("c%d: %v", i, errs[i])
+		}
+		for _, ip := range results[i] {
+			if j, ok := seen[ip]; ok {
+				t.Fatalf("%s allocated to c%d and c%d", ip, i, j)
+			}
+			seen[ip] = i
+		}
+	}
+	store, _ := NewStore(cfg.Name, cfg.DataDir)
+	defer store.Close()
+	if got := len(store.Allocated()); got != 2*n {
+		t.Fatalf("Expected %d allocated, got %d", 2*n, got)
+	}
+
+	// Release half concurrently
+	for i := 0; i < n; i += 2 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = Del(cfg, &Args{ContainerID: fmt.Sprintf("c%d", i), IfName: "eth0"})
+		}(i)
+	}
+	wg.Wait()
+	if got := len(store.Allocated()); got != n {
+		t.Fatalf("Expected %d allocated, got %d", n, got)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	_ = addresses(t, cfg, "c1")
+	_ = addresses(t, cfg, "c2")
+	del(t, cfg, "c2")
+	store, err := NewStore(cfg.Name, cfg.DataDir)
+	if err != nil {
+		t.Fatal("NewStore:", err)
+	}
+	defer store.Close()
+	to := filepath.Join(cfg.DataDir, "quarantine")
+	if err := store.Quarantine(to); err != nil {
+		t.Fatal("Quarantine:", err)
+	}
+	if n := len(store.Allocated()); n != 0 {
+		t.Fatal("Allocations left", n)
+	}
+	for _, f := range []string{"10.0.0.2", "last_reserved_ip.0", "released.json"} {
+		if _, err := os.Stat(filepath.Join(to, f)); err != nil {
+			t.Fatal("Not quarantined:", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(store.Dir(), "lock")); err != nil {
+		t.Fatal("Lock file removed")
+	}
+	// The allocator starts from scratch
+	if a := addresses(t, cfg, "c3"); a[0] != "10.0.0.2/24" {
+		t.Fatal("Unexpected", a)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cfg := testConfig(t,
+		[]Range{
+			{Subnet: "10.0.0.0/29", RangeEnd: "10.0.0.2"},
+			{Subnet: "10.0.0.0/29", RangeStart: "10.0.0.4"},
+		},
+		[]Range{{Subnet: "fd00::/120"}},
+	)
+	addresses(t, cfg, "c1")
+	addresses(t, cfg, "c2")
+	usage, err := Usage(cfg.Name, cfg.DataDir, cfg.Ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "[{10.0.0.0/29 4 2} {fd00::/120 254 2}]"
+	if fmt.Sprint(usage) != expect {
+		t.Fatalf("Expected %s, got %v", expect, usage)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	addresses(t, cfg, "c1")
+	// Written by an old host-local version
+	_ = os.WriteFile(filepath.Join(cfg.DataDir, cfg.Name, "10.0.0.9"), []byte("c2"), 0644)
+	owners := Owners(cfg.Name, cfg.DataDir)
+	expect := "map[10.0.0.2:{c1 eth0} 10.0.0.9:{c2 }]"
+	if fmt.Sprint(owners) != expect {
+		t.Fatalf("Expected %s, got %v", expect, owners)
+	}
+}
+
+func TestGC(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	addresses(t, cfg, "c1")
+	addresses(t, cfg, "c2")
+	if _, err := Add(cfg, &Args{ContainerID: "c1", IfName: "net1"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(cfg.DataDir, cfg.Name, "10.0.0.9"), []byte("old"), 0644)
+	valid := []Args{{ContainerID: "c1", IfName: "eth0"}, {ContainerID: "old", IfName: "eth0"}}
+	if err := GC(cfg, valid); err != nil {
+		t.Fatal("GC:", err)
+	}
+	expect := "map[10.0.0.2:{c1 eth0} 10.0.0.9:{old }]"
+	if owners := Owners(cfg.Name, cfg.DataDir); fmt.Sprint(owners) != expect {
+		t.Fatalf("Expected %s, got %v", expect, owners)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	if err := Status(cfg); err != nil {
+		t.Fatal("Status:", err)
+	}
+	cfg.Ranges = [][]Range{{{Subnet: "10.0.0.0/33"}}}
+	if err := Status(cfg); err == nil {
+		t.Fatal("Invalid range accepted")
+	}
+}
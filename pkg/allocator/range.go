@@ -0,0 +1,105 @@
+package allocator
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+)
+
+// Range A range item in the same format as for host-local
+type Range struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart,omitempty"`
+	RangeEnd   string `json:"rangeEnd,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+}
+
+// ipRange A parsed Range with defaults applied as in host-local
+type ipRange struct {
+	subnet *net.IPNet
+	start  net.IP
+	end    net.IP
+	gw     net.IP
+}
+
+func parseRange(r Range) (*ipRange, error) {
+	ip, subnet, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	if !ip.Equal(subnet.IP) {
+		return nil, fmt.Errorf("Network has host bits set %s", r.Subnet)
+	}
+	ones, bits := subnet.Mask.Size()
+	if bits == 32 && ones > 30 || bits == 128 && ones > 126 {
+		return nil, fmt.Errorf("Network %s too small to allocate from", r.Subnet)
+	}
+	parse := func(s string, def net.IP) (net.IP, error) {
+		if s == "" {
+			return def, nil
+		}
+		ip := canonicalize(net.ParseIP(s))
+		if ip == nil || !subnet.Contains(ip) {
+			return nil, fmt.Errorf("Invalid address %s in %s", s, r.Subnet)
+		}
+		return ip, nil
+	}
+	ir := ipRange{subnet: subnet}
+	if ir.gw, err = parse(r.Gateway, nextIP(subnet.IP)); err != nil {
+		return nil, err
+	}
+	if ir.start, err = parse(r.RangeStart, nextIP(subnet.IP)); err != nil {
+		return nil, err
+	}
+	if ir.end, err = parse(r.RangeEnd, lastIP(subnet)); err != nil {
+		return nil, err
+	}
+	if cmpIP(ir.start, ir.end) > 0 {
+		return nil, fmt.Errorf("RangeStart after RangeEnd in %s", r.Subnet)
+	}
+	return &ir, nil
+}
+
+// contains Returns true if the address is within start-end
+func (r *ipRange) contains(ip net.IP) bool {
+	ip = canonicalize(ip)
+	return r.subnet.Contains(ip) && cmpIP(ip, r.start) >= 0 && cmpIP(ip, r.end) <= 0
+}
+
+func canonicalize(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func cmpIP(a, b net.IP) int {
+	return bytes.Compare(canonicalize(a), canonicalize(b))
+}
+
+func nextIP(ip net.IP) net.IP {
+	ip = canonicalize(ip)
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// lastIP Returns the last address in the subnet. For IPv4 the
+// broadcast address is excluded
+func lastIP(subnet *net.IPNet) net.IP {
+	ip := canonicalize(subnet.IP)
+	end := make(net.IP, len(ip))
+	for i := range ip {
+		end[i] = ip[i] | ^subnet.Mask[i]
+	}
+	if len(end) == net.IPv4len {
+		end[3]--
+	}
+	return end
+}
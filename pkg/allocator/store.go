@@ -0,0 +1,221 @@
+package allocator
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// The on-disk format is the same as for host-local, so it is safe to
+// switch between host-local and this allocator. There is one file per
+// allocated address containing the container ID and interface name,
+// a "last_reserved_ip.<range-index>" file per range set and a "lock"
+// file used with flock(2).
+const (
+	DefaultDataDir   = "/var/lib/cni/networks"
+	lastIPFilePrefix = "last_reserved_ip."
+	lineBreak        = "\r\n"
+	releasedFile     = "released.json" // Not used by host-local
+)
+
+// Store A host-local compatible disk store
+type Store struct {
+	dir  string
+	lock *os.File
+	mu   sync.Mutex // flock doesn't exclude users of the same fd
+}
+
+// NewStore Opens a store for the network in dataDir. If dataDir is
+// empty DefaultDataDir is used
+func NewStore(network, dataDir string) (*Store, error) {
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, lock: f}, nil
+}
+
+// Dir Returns the directory of the store
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Lock Takes an exclusive lock
+func (s *Store) Lock() error {
+	s.mu.Lock()
+	if err := syscall.Flock(int(s.lock.Fd()), syscall.LOCK_EX); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Unlock Releases the lock
+func (s *Store) Unlock() error {
+	defer s.mu.Unlock()
+	return syscall.Flock(int(s.lock.Fd()), syscall.LOCK_UN)
+}
+
+// Close Closes the store
+func (s *Store) Close() error {
+	return s.lock.Close()
+}
+
+// Reserve Creates the file for the address. Returns false if the
+// address is already allocated
+func (s *Store) Reserve(id, ifname string, ip net.IP, rangeID string) (bool, error) {
+	fname := filepath.Join(s.dir, ip.String())
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.WriteString(strings.TrimSpace(id) + lineBreak + ifname); err != nil {
+		f.Close()
+		os.Remove(fname)
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(fname)
+		return false, err
+	}
+	ipfile := filepath.Join(s.dir, lastIPFilePrefix+rangeID)
+	if err := os.WriteFile(ipfile, []byte(ip.String()), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// LastReservedIP Returns the last reserved address in a range set
+func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, lastIPFilePrefix+rangeID))
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(string(data)), nil
+}
+
+// GetByID Returns the addresses allocated for a container interface.
+// Files written by old host-local versions contain only the ID
+func (s *Store) GetByID(id, ifname string) []net.IP {
+	var ips []net.IP
+	s.walk(id, ifname, func(path string, ip net.IP) {
+		ips = append(ips, ip)
+	})
+	return ips
+}
+
+// ReleaseByID Removes all addresses allocated for a container
+// interface. The release time is recorded
+func (s *Store) ReleaseByID(id, ifname string) error {
+	var err error
+	var released []net.IP
+	s.walk(id, ifname, func(path string, ip net.IP) {
+		if e := os.Remove(path); e != nil && !os.IsNotExist(e) {
+			err = e
+		} else {
+			released = append(released, ip)
+		}
+	})
+	if len(released) > 0 {
+		times := s.ReleaseTimes()
+		now := time.Now().UnixNano()
+		for _, ip := range released {
+			times[ip.String()] = now
+		}
+		if data, e := json.Marshal(times); e == nil {
+			_ = os.WriteFile(filepath.Join(s.dir, releasedFile), data, 0644)
+		}
+	}
+	return err
+}
+
+// ReleaseTimes Returns the last release time (unix nano) for released
+// addresses. Host-local doesn't record release times, so addresses
+// released by host-local are not included
+func (s *Store) ReleaseTimes() map[string]int64 {
+	times := make(map[string]int64)
+	if data, err := os.ReadFile(filepath.Join(s.dir, releasedFile)); err == nil {
+		_ = json.Unmarshal(data, &times)
+	}
+	return times
+}
+
+// Allocated Returns all allocated addresses
+func (s *Store) Allocated() []net.IP {
+	var ips []net.IP
+	entries, _ := os.ReadDir(s.dir)
+	for _, e := range entries {
+		if ip := net.ParseIP(e.Name()); ip != nil && !e.IsDir() {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// Quarantine Moves all allocations, including the last reserved and
+// release time files, to the "to" directory. If "to" is empty the
+// allocations are removed. The store must be locked
+func (s *Store) Quarantine(to string) error {
+	if to != "" {
+		if err := os.MkdirAll(to, 0755); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || net.ParseIP(name) == nil &&
+			!strings.HasPrefix(name, lastIPFilePrefix) && name != releasedFile {
+			continue
+		}
+		path := filepath.Join(s.dir, name)
+		if to == "" {
+			err = os.Remove(path)
+		} else {
+			err = os.Rename(path, filepath.Join(to, name))
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// walk Calls fn for each address file matching the container interface
+func (s *Store) walk(id, ifname string, fn func(path string, ip net.IP)) {
+	match := strings.TrimSpace(id) + lineBreak + ifname
+	matchOld := strings.TrimSpace(id)
+	entries, _ := os.ReadDir(s.dir)
+	for _, e := range entries {
+		ip := net.ParseIP(e.Name())
+		if ip == nil || e.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.dir, e.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if c := strings.TrimSpace(string(data)); c == match || c == matchOld {
+			fn(path, ip)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package allocator
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net"
+)
+
+// Allocation strategies
+const (
+	// Sequential Round-robin from the last reserved address, as host-local
+	Sequential = "sequential"
+	// Random Random address within the range set
+	Random = "random"
+	// LRU Never released addresses first, then the least recently released
+	LRU = "lru"
+	// PodHash Deterministic by a hash of namespace/pod name. Gives the
+	// same address to a restarted POD (e.g. in a StatefulSet) if free
+	PodHash = "pod-hash"
+)
+
+// ValidateStrategy Returns an error for unknown strategies. An empty
+// string means Sequential
+func ValidateStrategy(strategy string) error {
+	switch strategy {
+	case "", Sequential, Random, LRU, PodHash:
+		return nil
+	}
+	return fmt.Errorf("Unknown strategy [%s]", strategy)
+}
+
+// nextFn Returns the next candidate address and its range, or nil
+type nextFn func() (net.IP, *ipRange)
+
+// candidates Returns a function that returns addresses to try in the
+// order given by the strategy
+func candidates(
+	store *Store, set rangeSet, rangeID, strategy string, args *Args) (nextFn, error) {
+	switch strategy {
+	case "", Sequential:
+		return newIter(store, set, rangeID).next, nil
+	case Random:
+		n, err := rand.Int(rand.Reader, set.size())
+		if err != nil {
+			return nil, err
+		}
+		return set.iterAt(n).next, nil
+	case PodHash:
+		if args.PodNamespace == "" || args.PodName == "" {
+			// No POD identity, fallback to sequential
+			return newIter(store, set, rangeID).next, nil
+		}
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(args.PodNamespace + "/" + args.PodName))
+		n := new(big.Int).SetUint64(h.Sum64())
+		return set.iterAt(n.Mod(n, set.size())).next, nil
+	case LRU:
+		pick := lruPick(store, set)
+		seq := newIter(store, set, rangeID).next
+		return func() (net.IP, *ipRange) {
+			if pick != nil {
+				ip := pick
+				pick = nil
+				return ip, set.rangeFor(ip)
+			}
+			return seq()
+		}, nil
+	}
+	return nil, ValidateStrategy(strategy)
+}
+
+// lruPick Returns the first free address that has never been released,
+// or else the free address released longest ago. The allocated
+// addresses are listed once, and the scan for a never released address
+// is bounded by the number of allocated and released addresses. The
+// store must be locked
+func lruPick(store *Store, set rangeSet) net.IP {
+	times := store.ReleaseTimes()
+	used := make(map[string]bool)
+	for _, ip := range store.Allocated() {
+		used[ip.String()] = true
+	}
+	// At least one of this many addresses is neither allocated nor
+	// released, unless all are
+	n := len(used) + len(times) + 1
+	it := set.iterAt(big.NewInt(0))
+	for ip, _ := it.next(); ip != nil && n > 0; ip, _ = it.next() {
+		n--
+		if _, ok := times[ip.String()]; !ok && !used[ip.String()] {
+			return ip
+		}
+	}
+	var oldest net.IP
+	var oldestTime int64
+	for addr, t := range times {
+		ip := net.ParseIP(addr)
+		if ip == nil || used[addr] || set.rangeFor(ip) == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if oldest == nil || t < oldestTime || t == oldestTime && bytes.Compare(ip, oldest) < 0 {
+			oldest, oldestTime = ip, t
+		}
+	}
+	return oldest
+}
+
+// size Returns the number of addresses in the range
+func (r *ipRange) size() *big.Int {
+	n := new(big.Int).Sub(
+		new(big.Int).SetBytes(r.end), new(big.Int).SetBytes(r.start))
+	return n.Add(n, big.NewInt(1))
+}
+
+// size Returns the number of addresses in the range set
+func (s rangeSet) size() *big.Int {
+	n := big.NewInt(0)
+	for _, r := range s {
+		n.Add(n, r.size())
+	}
+	return n
+}
+
+// iterAt Returns an iterator that starts at address number n in the
+// range set and wraps around
+func (s rangeSet) iterAt(n *big.Int) *iter {
+	n = new(big.Int).Set(n)
+	for idx, r := range s {
+		if size := r.size(); n.Cmp(size) >= 0 {
+			n.Sub(n, size)
+			continue
+		}
+		addr := new(big.Int).SetBytes(r.start)
+		addr.Add(addr, n)
+		ip := make(net.IP, len(r.start))
+		addr.FillBytes(ip)
+		// The iterator advances before returning, so start before ip
+		return &iter{set: s, idx: idx, cur: prevIP(ip)}
+	}
+	return &iter{set: s}
+}
+
+func prevIP(ip net.IP) net.IP {
+	prev := make(net.IP, len(ip))
+	copy(prev, ip)
+	for i := len(prev) - 1; i >= 0; i-- {
+		prev[i]--
+		if prev[i] != 0xff {
+			break
+		}
+	}
+	return prev
+}
@@ -0,0 +1,115 @@
+package allocator
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func addPod(t *testing.T, cfg *Config, id, ns, name string) string {
+	res, err := Add(cfg, &Args{
+		ContainerID: id, IfName: "eth0", PodNamespace: ns, PodName: name})
+	if err != nil {
+		t.Fatalf("Add %s: %v", id, err)
+	}
+	return res.IPs[0].Address.IP.String()
+}
+
+func del(t *testing.T, cfg *Config, id string) {
+	if err := Del(cfg, &Args{ContainerID: id, IfName: "eth0"}); err != nil {
+		t.Fatalf("Del %s: %v", id, err)
+	}
+}
+
+func TestStrategyRandom(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}}, []Range{{Subnet: "fd00::/64"}})
+	cfg.Strategy = Random
+	seen := make(map[string]bool)
+	sequential := true
+	for i := 0; i < 20; i++ {
+		ip := addPod(t, cfg, fmt.Sprintf("c%d", i), "", "")
+		if seen[ip] {
+			t.Fatal("Duplicate", ip)
+		}
+		seen[ip] = true
+		if ip != fmt.Sprintf("10.0.0.%d", i+2) {
+			sequential = false
+		}
+	}
+	if sequential {
+		t.Fatal("Random allocation is sequential")
+	}
+
+	// All addresses in a small range must be found
+	cfg = testConfig(t, []Range{{Subnet: "10.0.0.0/29"}})
+	cfg.Strategy = Random
+	for i := 0; i < 5; i++ {
+		_ = addPod(t, cfg, fmt.Sprintf("c%d", i), "", "")
+	}
+	if _, err := Add(cfg, &Args{ContainerID: "c5", IfName: "eth0"}); err == nil {
+		t.Fatal("Expected exhaustion")
+	}
+}
+
+func TestStrategyPodHash(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/16"}})
+	cfg.Strategy = PodHash
+	ip1 := addPod(t, cfg, "c1", "default", "web-0")
+	ip2 := addPod(t, cfg, "c2", "default", "web-1")
+	if ip1 == ip2 {
+		t.Fatal("Same address for different PODs", ip1)
+	}
+	del(t, cfg, "c1")
+	_ = addPod(t, cfg, "c3", "default", "other")
+	if ip := addPod(t, cfg, "c4", "default", "web-0"); ip != ip1 {
+		t.Fatalf("Restarted POD got %s, expected %s", ip, ip1)
+	}
+	// Taken, the next address is used
+	if ip := addPod(t, cfg, "c5", "default", "web-0"); ip == ip1 {
+		t.Fatal("Allocated address handed out again", ip)
+	}
+}
+
+func TestStrategyLRU(t *testing.T) {
+	// Allocatable 10.0.0.2 - 10.0.0.6
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/29"}})
+	cfg.Strategy = LRU
+	for i := 1; i <= 4; i++ {
+		if ip := addPod(t, cfg, fmt.Sprintf("c%d", i), "", ""); ip != fmt.Sprintf("10.0.0.%d", i+1) {
+			t.Fatalf("c%d: got %s", i, ip)
+		}
+	}
+	del(t, cfg, "c3") // 10.0.0.4
+	time.Sleep(time.Millisecond)
+	del(t, cfg, "c1") // 10.0.0.2
+
+	expect := []string{"10.0.0.6", "10.0.0.4", "10.0.0.2"}
+	for i, e := range expect {
+		if ip := addPod(t, cfg, fmt.Sprintf("c%d", i+5), "", ""); ip != e {
+			t.Fatalf("c%d: expected %s, got %s", i+5, e, ip)
+		}
+	}
+}
+
+func TestStrategyLRUIPv6(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "fd00::/64"}})
+	cfg.Strategy = LRU
+	for i, e := range []string{"fd00::2", "fd00::3"} {
+		if ip := addPod(t, cfg, fmt.Sprintf("c%d", i+1), "", ""); ip != e {
+			t.Fatalf("c%d: expected %s, got %s", i+1, e, ip)
+		}
+	}
+	del(t, cfg, "c1")
+	// A never released address before the released fd00::2
+	if ip := addPod(t, cfg, "c3", "", ""); ip != "fd00::4" {
+		t.Fatalf("c3: got %s", ip)
+	}
+}
+
+func TestStrategyUnknown(t *testing.T) {
+	cfg := testConfig(t, []Range{{Subnet: "10.0.0.0/24"}})
+	cfg.Strategy = "best"
+	if _, err := Add(cfg, &Args{ContainerID: "c1", IfName: "eth0"}); err == nil {
+		t.Fatal("Expected error")
+	}
+}
@@ -0,0 +1,79 @@
+package allocator
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RangeUsage The address usage in a subnet
+type RangeUsage struct {
+	Subnet    string
+	Size      float64 // Allocatable addresses, the gateway excluded
+	Allocated float64
+}
+
+// Usage Returns the usage per subnet in the range sets. A subnet may
+// be split in several range items, e.g. by exclusions. The store is
+// read without locking, so the result may be slightly outdated
+func Usage(network, dataDir string, ranges [][]Range) ([]RangeUsage, error) {
+	sets, err := parseRangeSets(ranges)
+	if err != nil {
+		return nil, err
+	}
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	allocated := (&Store{dir: filepath.Join(dataDir, network)}).Allocated()
+	var usage []RangeUsage
+	index := make(map[string]int)
+	for _, set := range sets {
+		for _, r := range set {
+			subnet := r.subnet.String()
+			i, ok := index[subnet]
+			if !ok {
+				i = len(usage)
+				index[subnet] = i
+				usage = append(usage, RangeUsage{Subnet: subnet})
+			}
+			size, _ := new(big.Float).SetInt(r.size()).Float64()
+			if r.contains(r.gw) {
+				size--
+			}
+			usage[i].Size += size
+			for _, ip := range allocated {
+				if r.contains(ip) {
+					usage[i].Allocated++
+				}
+			}
+		}
+	}
+	return usage, nil
+}
+
+// Owner The container interface an address is allocated for. IfName
+// is empty for files written by old host-local versions
+type Owner struct {
+	ID     string
+	IfName string
+}
+
+// Owners Returns the owner of each allocated address. The store is
+// read without locking, so the result may be slightly outdated
+func Owners(network, dataDir string) map[string]Owner {
+	if dataDir == "" {
+		dataDir = DefaultDataDir
+	}
+	dir := filepath.Join(dataDir, network)
+	owners := make(map[string]Owner)
+	for _, ip := range (&Store{dir: dir}).Allocated() {
+		data, err := os.ReadFile(filepath.Join(dir, ip.String()))
+		if err != nil {
+			continue
+		}
+		id, ifname, _ := strings.Cut(strings.TrimSpace(string(data)), lineBreak)
+		owners[ip.String()] = Owner{ID: strings.TrimSpace(id), IfName: ifname}
+	}
+	return owners
+}
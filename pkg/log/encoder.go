@@ -0,0 +1,96 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/buffer"
+	"go.uber.org/zap/zapcore"
+)
+
+// Encodings
+const (
+	EncodingJSON    = "json"
+	EncodingConsole = "console"
+	EncodingLogfmt  = "logfmt"
+)
+
+var bufferPool = buffer.NewPool()
+
+func newEncoder(encoding string) (zapcore.Encoder, error) {
+	ec := zap.NewProductionEncoderConfig()
+	ec.EncodeTime = zapcore.ISO8601TimeEncoder
+	switch encoding {
+	case "", EncodingJSON:
+		return zapcore.NewJSONEncoder(ec), nil
+	case EncodingConsole:
+		return zapcore.NewConsoleEncoder(ec), nil
+	case EncodingLogfmt:
+		return &logfmtEncoder{Encoder: zapcore.NewJSONEncoder(ec)}, nil
+	}
+	return nil, fmt.Errorf("Unknown encoding [%s]", encoding)
+}
+
+// logfmtEncoder Encodes entries as "key=value" pairs. The entry is
+// encoded as json and then converted, with nested objects and arrays
+// kept as (quoted) json
+type logfmtEncoder struct {
+	zapcore.Encoder
+}
+
+func (e *logfmtEncoder) Clone() zapcore.Encoder {
+	return &logfmtEncoder{Encoder: e.Encoder.Clone()}
+}
+
+func (e *logfmtEncoder) EncodeEntry(ent zapcore.Entry, fields []zapcore.Field) (*buffer.Buffer, error) {
+	jbuf, err := e.Encoder.EncodeEntry(ent, fields)
+	if err != nil {
+		return nil, err
+	}
+	defer jbuf.Free()
+	dec := json.NewDecoder(bytes.NewReader(jbuf.Bytes()))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("Not a json object")
+	}
+	buf := bufferPool.Get()
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			buf.Free()
+			return nil, err
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			buf.Free()
+			return nil, err
+		}
+		if buf.Len() > 0 {
+			buf.AppendByte(' ')
+		}
+		buf.AppendString(fmt.Sprint(t))
+		buf.AppendByte('=')
+		buf.AppendString(logfmtValue(raw))
+	}
+	buf.AppendByte('\n')
+	return buf, nil
+}
+
+// logfmtValue Returns a json value in logfmt format. Strings are
+// quoted if needed
+func logfmtValue(raw json.RawMessage) string {
+	s := string(raw)
+	if len(raw) > 0 && raw[0] == '"' {
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return string(raw)
+		}
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\n\\") {
+		return strconv.Quote(s)
+	}
+	return s
+}
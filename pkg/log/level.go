@@ -0,0 +1,42 @@
+package log
+
+import (
+	"strings"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// namedLevelCore Filters entries on a level per logger name. The
+// wrapped core must enable the lowest level
+type namedLevelCore struct {
+	zapcore.Core
+	level zapcore.Level            // Default level
+	named map[string]zapcore.Level // Per logger name
+}
+
+func (c *namedLevelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &namedLevelCore{Core: c.Core.With(fields), level: c.level, named: c.named}
+}
+
+func (c *namedLevelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level < c.levelFor(ent.LoggerName) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// levelFor Returns the level for a logger name. The longest matching
+// name, or name prefix ("api" for "api.nodes"), is used
+func (c *namedLevelCore) levelFor(name string) zapcore.Level {
+	for name != "" {
+		if lvl, ok := c.named[name]; ok {
+			return lvl
+		}
+		i := strings.LastIndex(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return c.level
+}
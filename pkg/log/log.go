@@ -15,32 +15,51 @@ import (
 )
 
 // ZapLogger returns a default logger to use in NewContext.
-// Allowed levels are "debug" or "trace", anything else is "info".
+// See ParseLevel for allowed levels. DefaultMask keys are redacted.
 func ZapLogger(output, level string) (*zap.Logger, error) {
 	if output == "" {
 		return nil, fmt.Errorf("No output")
 	}
-
-	var lvl = 0
-	switch strings.ToLower(level) {
-	case "debug":
-		lvl = -1
-	case "trace":
-		lvl = -2
-	default:
-		lvl, _ = strconv.Atoi(level)
-		if lvl > 0 {
-			lvl = -lvl
-		}
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
 	}
 
 	zc := zap.NewProductionConfig()
-	zc.Level = zap.NewAtomicLevelAt(zapcore.Level(lvl))
+	zc.Level = zap.NewAtomicLevelAt(lvl)
 	zc.DisableStacktrace = true
 	zc.DisableCaller = true
 	zc.OutputPaths = []string{output}
 	zc.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-	return zc.Build()
+	return zc.Build(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &redactCore{Core: c, r: newRedactor(nil)}
+	}))
+}
+
+// ParseLevel Returns the zap level. Allowed levels are "error",
+// "warn", "info" (or empty), "debug", "trace" or a logr verbosity
+// (V-level) number
+func ParseLevel(level string) (zapcore.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "info":
+		return zapcore.InfoLevel, nil
+	case "error":
+		return zapcore.ErrorLevel, nil
+	case "warn", "warning":
+		return zapcore.WarnLevel, nil
+	case "debug":
+		return zapcore.DebugLevel, nil
+	case "trace":
+		return zapcore.Level(-2), nil
+	}
+	lvl, err := strconv.Atoi(level)
+	if err != nil || lvl > 127 || lvl < -127 {
+		return 0, fmt.Errorf("Invalid log level [%s]", level)
+	}
+	if lvl > 0 {
+		lvl = -lvl
+	}
+	return zapcore.Level(lvl), nil
 }
 
 // NewContext returns a context with a logr.Logger based on the passed zap.Logger.
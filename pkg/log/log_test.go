@@ -35,3 +35,18 @@ func TestLogger(t *testing.T) {
 	logger.V(10).Info("You should see this (10)")
 	logger.V(11).Info("You should NOT see this (11)")
 }
+
+func TestParseLevel(t *testing.T) {
+	tcs := map[string]int8{"": 0, "info": 0, "error": 2, "warn": 1, "debug": -1, "trace": -2, "4": -4}
+	for level, expect := range tcs {
+		lvl, err := ParseLevel(level)
+		if err != nil || int8(lvl) != expect {
+			t.Fatalf("%s: expected %d, got %d %v", level, expect, lvl, err)
+		}
+	}
+	for _, level := range []string{"verbose", "-1x"} {
+		if _, err := ParseLevel(level); err == nil {
+			t.Fatal("Expected error for", level)
+		}
+	}
+}
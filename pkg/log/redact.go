@@ -0,0 +1,190 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Masked Replaces the value of masked keys
+const Masked = "<redacted>"
+
+// DefaultMask Keys that are always masked
+var DefaultMask = []string{
+	"kubeconfig", "token", "password", "secret", "credential",
+	"authorization", "privatekey",
+}
+
+// PodIdentityKeys Keys that are hashed with Redaction.HashPodIdentity
+var PodIdentityKeys = []string{
+	"podName", "podNamespace", "podUID",
+	"K8S_POD_NAME", "K8S_POD_NAMESPACE", "K8S_POD_UID",
+}
+
+// Redaction Configures masking and hashing of logged values. Keys are
+// matched case insensitive, ignoring "-" and "_", on all levels in
+// logged objects
+type Redaction struct {
+	// Mask Keys to mask, in addition to DefaultMask. A key matches if
+	// it contains a masked key, e.g. "bearerToken" matches "token"
+	Mask []string `json:"mask,omitempty"`
+	// Hash Keys with string values to hash. Exact match
+	Hash []string `json:"hash,omitempty"`
+	// HashPodIdentity Also hash the PodIdentityKeys
+	HashPodIdentity bool `json:"hashPodIdentity,omitempty"`
+}
+
+type redactor struct {
+	mask []string
+	hash map[string]bool
+}
+
+func newRedactor(r *Redaction) *redactor {
+	if r == nil {
+		r = &Redaction{}
+	}
+	rd := &redactor{hash: make(map[string]bool)}
+	for _, k := range append(DefaultMask, r.Mask...) {
+		rd.mask = append(rd.mask, normalizeKey(k))
+	}
+	hash := r.Hash
+	if r.HashPodIdentity {
+		hash = append(hash, PodIdentityKeys...)
+	}
+	for _, k := range hash {
+		rd.hash[normalizeKey(k)] = true
+	}
+	return rd
+}
+
+func normalizeKey(key string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(key))
+}
+
+func (r *redactor) masked(key string) bool {
+	key = normalizeKey(key)
+	for _, m := range r.mask {
+		if strings.Contains(key, m) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashValue Returns a short hash. Equal values give equal hashes so
+// log lines can still be correlated
+func hashValue(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// field Returns a redacted field. Errors and Stringers are redacted as
+// strings. Objects are converted to json and redacted on all levels
+func (r *redactor) field(f zapcore.Field) zapcore.Field {
+	if r.masked(f.Key) {
+		return zap.String(f.Key, Masked)
+	}
+	switch f.Type {
+	case zapcore.StringType:
+		return zap.String(f.Key, r.str(f.Key, f.String))
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok {
+			return zap.String(f.Key, r.str(f.Key, err.Error()))
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok {
+			return zap.String(f.Key, r.str(f.Key, s.String()))
+		}
+	case zapcore.ReflectType:
+		data, err := json.Marshal(f.Interface)
+		if err != nil {
+			return zap.String(f.Key, Masked)
+		}
+		var v any
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return zap.String(f.Key, Masked)
+		}
+		return zap.Any(f.Key, r.value(f.Key, v))
+	}
+	return f
+}
+
+func (r *redactor) fields(fields []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		out[i] = r.field(f)
+	}
+	return out
+}
+
+// value Redacts a decoded json value. Array items inherit the key
+func (r *redactor) value(key string, v any) any {
+	if r.masked(key) {
+		return Masked
+	}
+	switch t := v.(type) {
+	case map[string]any:
+		for k, item := range t {
+			t[k] = r.value(k, item)
+		}
+	case []any:
+		for i, item := range t {
+			t[i] = r.value(key, item)
+		}
+	case string:
+		return r.str(key, t)
+	}
+	return v
+}
+
+// str Redacts a string value. CNI_ARGS ("key=value;...") is redacted
+// per argument
+func (r *redactor) str(key, s string) string {
+	if r.hash[normalizeKey(key)] {
+		return hashValue(s)
+	}
+	if key != "CNI_ARGS" {
+		return s
+	}
+	args := strings.Split(s, ";")
+	for i, arg := range args {
+		if k, v, ok := strings.Cut(arg, "="); ok {
+			if r.masked(k) {
+				args[i] = k + "=" + Masked
+			} else {
+				args[i] = k + "=" + r.str(k, v)
+			}
+		}
+	}
+	return strings.Join(args, ";")
+}
+
+// redactCore Redacts fields before they are written to the wrapped
+// core
+type redactCore struct {
+	zapcore.Core
+	r *redactor
+}
+
+func (c *redactCore) With(fields []zapcore.Field) zapcore.Core {
+	return &redactCore{Core: c.Core.With(c.r.fields(fields)), r: c.r}
+}
+
+func (c *redactCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *redactCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	return c.Core.Write(ent, c.r.fields(fields))
+}
@@ -0,0 +1,122 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/zapr"
+	"go.uber.org/zap"
+)
+
+type testIPAM struct {
+	Type       string `json:"type"`
+	KubeConfig string `json:"kubeconfig"`
+	LogLevel   string `json:"loglevel"`
+}
+
+// testStringer A fmt.Stringer
+type testStringer string
+
+func (s testStringer) String() string { return string(s) }
+
+type testConfig struct {
+	Name          string            `json:"name"`
+	IPAM          *testIPAM         `json:"ipam"`
+	RuntimeConfig map[string]any    `json:"runtimeConfig"`
+	Annotations   map[string]string `json:"annotations"`
+}
+
+func TestRedaction(t *testing.T) {
+	dir := t.TempDir()
+	sinks := []Sink{
+		{Type: SinkFile, Path: filepath.Join(dir, "json.log")},
+		{Type: SinkFile, Path: filepath.Join(dir, "logfmt.log"), Encoding: EncodingLogfmt},
+	}
+	z, err := NewLogger(&Config{
+		Sinks: sinks,
+		Level: "trace",
+		Redaction: &Redaction{
+			Mask: []string{"api-key"}, HashPodIdentity: true},
+	})
+	if err != nil {
+		t.Fatal("NewLogger:", err)
+	}
+	logger := zapr.NewLogger(z).WithValues("podName", "SECRET-pod", "podNamespace", "SECRET-ns")
+	cfg := &testConfig{
+		Name: "k8snet",
+		IPAM: &testIPAM{Type: "kube-node", KubeConfig: "/SECRET/kubeconfig", LogLevel: "trace"},
+		RuntimeConfig: map[string]any{
+			"bearerToken": "SECRET-1",
+			"auth":        []any{map[string]any{"password": "SECRET-2"}},
+		},
+		Annotations: map[string]string{"API_KEY": "SECRET-3"},
+	}
+	logger.V(2).Info(
+		"Started", "CNI_COMMAND", "ADD",
+		"CNI_ARGS", "IgnoreUnknown=1;K8S_POD_NAMESPACE=SECRET-ns;K8S_POD_NAME=SECRET-pod;K8S_POD_TOKEN=SECRET-4",
+		"CniConfigIn", cfg)
+	logger.V(2).Info("execChained result", "stdout", map[string]any{
+		"ips": []any{map[string]any{"address": "10.0.0.2/24"}},
+	})
+	logger.Info("Token", "token", "SECRET-5")
+
+	for _, s := range sinks {
+		data, _ := os.ReadFile(s.Path)
+		log := string(data)
+		if strings.Count(log, "\n") != 3 {
+			t.Fatalf("%s: expected 3 lines %q", s.Path, log)
+		}
+		if strings.Contains(log, "SECRET") {
+			t.Fatalf("%s: not redacted %q", s.Path, log)
+		}
+		for _, e := range []string{"k8snet", "10.0.0.2/24", "IgnoreUnknown=1", hashValue("SECRET-pod"), Masked} {
+			if !strings.Contains(log, e) {
+				t.Fatalf("%s: expected %s in %q", s.Path, e, log)
+			}
+		}
+	}
+
+	// Pod identities are not hashed by default, but secrets are masked
+	path := filepath.Join(dir, "default.log")
+	z, _ = NewLogger(&Config{Sinks: []Sink{{Type: SinkFile, Path: path}}})
+	z.Sugar().Infow("Default", "podName", "my-pod", "kubeconfig", "SECRET")
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "my-pod") || strings.Contains(string(data), "SECRET") {
+		t.Fatalf("Unexpected %q", data)
+	}
+}
+
+func TestRedactErrorStringer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube-node.log")
+	z, err := NewLogger(&Config{
+		Sinks:     []Sink{{Type: SinkFile, Path: path}},
+		Redaction: &Redaction{Hash: []string{"podName"}},
+	})
+	if err != nil {
+		t.Fatal("NewLogger:", err)
+	}
+	z.Info("Error",
+		zap.NamedError("podName", errors.New("SECRET-pod")),
+		zap.NamedError("token", errors.New("SECRET-1")),
+		zap.Error(errors.New("Not found")))
+	z.Info("Stringer",
+		zap.Stringer("podName", testStringer("SECRET-pod")),
+		zap.Stringer("password", testStringer("SECRET-2")),
+		zap.Stringer("node", testStringer("vm-002")))
+	// Also for logr
+	zapr.NewLogger(z).Error(errors.New("Timeout"), "Failed", "credentials", errors.New("SECRET-3"))
+
+	data, _ := os.ReadFile(path)
+	log := string(data)
+	if strings.Contains(log, "SECRET") {
+		t.Fatalf("Not redacted %q", log)
+	}
+	for _, e := range []string{hashValue("SECRET-pod"), Masked, "Not found", "vm-002", "Timeout"} {
+		if !strings.Contains(log, e) {
+			t.Fatalf("Expected %s in %q", e, log)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package log
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/rotate"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Sink types
+const (
+	SinkStderr   = "stderr"
+	SinkFile     = "file"
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
+)
+
+// JournaldSocket The journald native protocol socket
+var JournaldSocket = "/run/systemd/journal/socket"
+
+// Sink A log destination. Stdout is not allowed since it's used for
+// the CNI result
+type Sink struct {
+	Type string `json:"type"`
+	// Path The file for "file" sinks
+	Path string `json:"path,omitempty"`
+	// MaxSize in MiB, MaxAge in days. The file is rotated at either.
+	// Used by "file"
+	MaxSize    int `json:"maxSize,omitempty"`
+	MaxBackups int `json:"maxBackups,omitempty"`
+	MaxAge     int `json:"maxAge,omitempty"`
+	// Network and Address of a remote syslog. Local syslog if empty
+	Network string `json:"network,omitempty"`
+	Address string `json:"address,omitempty"`
+	// Tag The syslog tag or journald SYSLOG_IDENTIFIER
+	Tag string `json:"tag,omitempty"`
+	// Encoding Overrides the encoding in Config
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Config A logger configuration
+type Config struct {
+	Sinks    []Sink
+	Level    string // See ParseLevel
+	Encoding string // Default "json"
+	// Levels Per named logger (subsystem), e.g. {"api": "trace"}. A
+	// name also applies to sub-loggers, e.g. "api.nodes"
+	Levels map[string]string
+	// Redaction Defaults are used if nil
+	Redaction *Redaction
+}
+
+// NewLogger Returns a logger that writes to all sinks in the config.
+// Logged values are redacted, see Redaction
+func NewLogger(cfg *Config) (*zap.Logger, error) {
+	if len(cfg.Sinks) == 0 {
+		return nil, fmt.Errorf("No sinks")
+	}
+	lvl, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+	named := make(map[string]zapcore.Level)
+	minLevel := lvl
+	for name, level := range cfg.Levels {
+		l, err := ParseLevel(level)
+		if err != nil {
+			return nil, fmt.Errorf("Logger %s: %w", name, err)
+		}
+		named[name] = l
+		if l < minLevel {
+			minLevel = l
+		}
+	}
+	var cores []zapcore.Core
+	for _, s := range cfg.Sinks {
+		encoding := s.Encoding
+		if encoding == "" {
+			encoding = cfg.Encoding
+		}
+		enc, err := newEncoder(encoding)
+		if err != nil {
+			return nil, fmt.Errorf("Sink %s: %w", s.Type, err)
+		}
+		core, err := newCore(s, enc, minLevel)
+		if err != nil {
+			return nil, fmt.Errorf("Sink %s: %w", s.Type, err)
+		}
+		cores = append(cores, core)
+	}
+	var core zapcore.Core = &redactCore{
+		Core: zapcore.NewTee(cores...), r: newRedactor(cfg.Redaction)}
+	if len(named) > 0 {
+		core = &namedLevelCore{Core: core, level: lvl, named: named}
+	}
+	return zap.New(core), nil
+}
+
+// NewFallbackLogger Returns a logger as NewLogger. If the config is
+// invalid, e.g. an unknown level, the configured sinks are kept with
+// the default level and encoding, and sinks that can't be created are
+// skipped. Stderr is used if no sink remains. The logger is never nil
+// and the config error is returned so it can be logged
+func NewFallbackLogger(cfg *Config) (*zap.Logger, error) {
+	logger, err := NewLogger(cfg)
+	if err == nil {
+		return logger, nil
+	}
+	var cores []zapcore.Core
+	for _, s := range cfg.Sinks {
+		enc, _ := newEncoder("")
+		if core, cerr := newCore(s, enc, zapcore.InfoLevel); cerr == nil {
+			cores = append(cores, core)
+		}
+	}
+	if len(cores) == 0 {
+		enc, _ := newEncoder("")
+		cores = append(cores, zapcore.NewCore(enc, zapcore.Lock(os.Stderr), zapcore.InfoLevel))
+	}
+	core := &redactCore{Core: zapcore.NewTee(cores...), r: newRedactor(cfg.Redaction)}
+	return zap.New(core), err
+}
+
+func newCore(s Sink, enc zapcore.Encoder, lvl zapcore.LevelEnabler) (zapcore.Core, error) {
+	tag := s.Tag
+	if tag == "" {
+		tag = "kube-node"
+	}
+	switch s.Type {
+	case SinkStderr:
+		return zapcore.NewCore(enc, zapcore.Lock(os.Stderr), lvl), nil
+	case SinkFile:
+		if s.Path == "" {
+			return nil, fmt.Errorf("No path")
+		}
+		f := rotate.New(s.Path, s.MaxSize, s.MaxBackups)
+		f.MaxAge = time.Duration(s.MaxAge) * 24 * time.Hour
+		return zapcore.NewCore(enc, zapcore.AddSync(f), lvl), nil
+	case SinkSyslog:
+		w, err := syslog.Dial(s.Network, s.Address, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+		if err != nil {
+			return nil, err
+		}
+		return &levelCore{LevelEnabler: lvl, enc: enc, out: &syslogWriter{w: w}}, nil
+	case SinkJournald:
+		conn, err := net.Dial("unixgram", JournaldSocket)
+		if err != nil {
+			return nil, err
+		}
+		return &levelCore{LevelEnabler: lvl, enc: enc, out: &journaldWriter{conn: conn, tag: tag}}, nil
+	}
+	return nil, fmt.Errorf("Unknown sink type [%s]", s.Type)
+}
+
+// levelWriter A writer that uses the log level, e.g. as syslog priority
+type levelWriter interface {
+	WriteLevel(lvl zapcore.Level, p []byte) error
+}
+
+// levelCore A zapcore.Core for level aware writers
+type levelCore struct {
+	zapcore.LevelEnabler
+	enc zapcore.Encoder
+	out levelWriter
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	enc := c.enc.Clone()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	return &levelCore{LevelEnabler: c.LevelEnabler, enc: enc, out: c.out}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *levelCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	buf, err := c.enc.EncodeEntry(ent, fields)
+	if err != nil {
+		return err
+	}
+	defer buf.Free()
+	return c.out.WriteLevel(ent.Level, buf.Bytes())
+}
+
+func (c *levelCore) Sync() error {
+	return nil
+}
+
+// priority Returns the syslog priority (severity) for a level. Debug
+// levels (V(1) and up) are negative
+func priority(lvl zapcore.Level) syslog.Priority {
+	switch {
+	case lvl >= zapcore.ErrorLevel:
+		return syslog.LOG_ERR
+	case lvl == zapcore.WarnLevel:
+		return syslog.LOG_WARNING
+	case lvl == zapcore.InfoLevel:
+		return syslog.LOG_INFO
+	}
+	return syslog.LOG_DEBUG
+}
+
+type syslogWriter struct {
+	w *syslog.Writer
+}
+
+func (s *syslogWriter) WriteLevel(lvl zapcore.Level, p []byte) error {
+	msg := strings.TrimSuffix(string(p), "\n")
+	switch priority(lvl) {
+	case syslog.LOG_ERR:
+		return s.w.Err(msg)
+	case syslog.LOG_WARNING:
+		return s.w.Warning(msg)
+	case syslog.LOG_INFO:
+		return s.w.Info(msg)
+	}
+	return s.w.Debug(msg)
+}
+
+// journaldWriter Writes to journald using the native protocol, see
+// https://systemd.io/JOURNAL_NATIVE_PROTOCOL/
+type journaldWriter struct {
+	conn net.Conn
+	tag  string
+}
+
+func (j *journaldWriter) WriteLevel(lvl zapcore.Level, p []byte) error {
+	_, err := j.conn.Write(journaldMessage(j.tag, priority(lvl), p))
+	return err
+}
+
+// journaldMessage Returns a datagram in the journald native format.
+// The message is sent in the binary format if it contains newlines
+func journaldMessage(tag string, prio syslog.Priority, p []byte) []byte {
+	msg := strings.TrimSuffix(string(p), "\n")
+	var b strings.Builder
+	fmt.Fprintf(&b, "PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\n", prio, tag)
+	if !strings.Contains(msg, "\n") {
+		b.WriteString("MESSAGE=" + msg + "\n")
+		return []byte(b.String())
+	}
+	b.WriteString("MESSAGE\n")
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(msg)))
+	b.Write(size[:])
+	b.WriteString(msg + "\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestSinks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kube-node.log")
+
+	// journald
+	JournaldSocket = filepath.Join(dir, "journal.socket")
+	journal, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: JournaldSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+
+	// Remote syslog
+	syslogd, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syslogd.Close()
+
+	z, err := NewLogger(&Config{Sinks: []Sink{
+		{Type: SinkStderr},
+		{Type: SinkFile, Path: path},
+		{Type: SinkJournald},
+		{Type: SinkSyslog, Network: "udp", Address: syslogd.LocalAddr().String()},
+	}, Level: "debug"})
+	if err != nil {
+		t.Fatal("NewLogger:", err)
+	}
+	z.Info("Hello, world")
+	z.Debug("Multi\nline")
+	z.Named("cache").Error("Failed")
+
+	data, _ := os.ReadFile(path)
+	if n := strings.Count(string(data), "\n"); n != 3 {
+		t.Fatalf("Expected 3 lines in file, got %d", n)
+	}
+	buf := make([]byte, 4096)
+	expect := []string{"PRIORITY=6\n", "PRIORITY=7\n", "PRIORITY=3\n"}
+	for i, e := range expect {
+		n, err := journal.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, e) || !strings.Contains(msg, "SYSLOG_IDENTIFIER=kube-node\n") {
+			t.Fatalf("Unexpected journal message %q", msg)
+		}
+		if i == 1 && !strings.Contains(msg, `Multi\nline`) {
+			t.Fatalf("Expected escaped newline %q", msg)
+		}
+	}
+	// Binary format is used for messages with newlines
+	msg := journaldMessage("kube-node", 6, []byte("Multi\nline\n"))
+	if string(msg) != "PRIORITY=6\nSYSLOG_IDENTIFIER=kube-node\nMESSAGE\n\x0a\x00\x00\x00\x00\x00\x00\x00Multi\nline\n" {
+		t.Fatalf("Unexpected binary message %q", msg)
+	}
+	n, _, err := syslogd.ReadFrom(buf)
+	if err != nil || !strings.Contains(string(buf[:n]), "Hello, world") {
+		t.Fatalf("Unexpected syslog message %q %v", buf[:n], err)
+	}
+
+	stderr := []Sink{{Type: SinkStderr}}
+	invalid := []*Config{
+		{},
+		{Sinks: []Sink{{Type: "stdout"}}},
+		{Sinks: []Sink{{Type: SinkFile}}},
+		{Sinks: stderr, Level: "verbose"},
+		{Sinks: stderr, Encoding: "xml"},
+		{Sinks: stderr, Levels: map[string]string{"api": "loud"}},
+	}
+	for _, cfg := range invalid {
+		if _, err := NewLogger(cfg); err == nil {
+			t.Fatalf("Expected error for %+v", cfg)
+		}
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	tcs := []struct {
+		encoding string
+		expect   []string
+	}{
+		{encoding: "", expect: []string{`"msg":"Hello, world"`, `"n":1`}},
+		{encoding: EncodingConsole, expect: []string{"\tHello, world\t", `{"n": 1, "ip": "10.0.0.1"`}},
+		{encoding: EncodingLogfmt, expect: []string{`level=info `, `msg="Hello, world" n=1 ip=10.0.0.1 m="{\"a\":\"b\"}"`}},
+	}
+	for _, tc := range tcs {
+		path := filepath.Join(t.TempDir(), "kube-node.log")
+		z, err := NewLogger(&Config{Sinks: []Sink{{Type: SinkFile, Path: path}}, Encoding: tc.encoding})
+		if err != nil {
+			t.Fatal("NewLogger:", err)
+		}
+		z.Info("Hello, world", zap.Int("n", 1), zap.String("ip", "10.0.0.1"), zap.Any("m", map[string]string{"a": "b"}))
+		data, _ := os.ReadFile(path)
+		for _, e := range tc.expect {
+			if !strings.Contains(string(data), e) {
+				t.Fatalf("%s: expected %s in %q", tc.encoding, e, data)
+			}
+		}
+	}
+}
+
+func TestNamedLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube-node.log")
+	z, err := NewLogger(&Config{
+		Sinks:  []Sink{{Type: SinkFile, Path: path}},
+		Levels: map[string]string{"api": "trace", "cache": "error"},
+	})
+	if err != nil {
+		t.Fatal("NewLogger:", err)
+	}
+	z.Named("api").Debug("api debug")
+	z.Named("api").Named("nodes").With(zap.Int("n", 1)).Debug("nodes debug")
+	z.Named("cache").Info("cache info")
+	z.Named("delegate").Debug("delegate debug")
+	z.Named("delegate").Info("delegate info")
+	data, _ := os.ReadFile(path)
+	for _, msg := range []string{"api debug", "nodes debug", "delegate info"} {
+		if !strings.Contains(string(data), msg) {
+			t.Fatalf("Expected %q in %q", msg, data)
+		}
+	}
+	for _, msg := range []string{"cache info", "delegate debug"} {
+		if strings.Contains(string(data), msg) {
+			t.Fatalf("Unexpected %q in %q", msg, data)
+		}
+	}
+}
+
+func TestFallbackLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kube-node.log")
+	z, err := NewFallbackLogger(&Config{
+		Sinks: []Sink{{Type: SinkFile, Path: path}, {Type: SinkFile}},
+		Level: "verbose",
+	})
+	if err == nil {
+		t.Fatal("Invalid level accepted")
+	}
+	z.Error("Log config", zap.Error(err))
+	z.Debug("Not logged")
+	z.Info("Info", zap.String("secret", "value"))
+	data, _ := os.ReadFile(path)
+	for _, msg := range []string{"Log config", "verbose", "Info", Masked} {
+		if !strings.Contains(string(data), msg) {
+			t.Fatalf("Expected %q in %q", msg, data)
+		}
+	}
+	for _, msg := range []string{"Not logged", "value"} {
+		if strings.Contains(string(data), msg) {
+			t.Fatalf("Unexpected %q in %q", msg, data)
+		}
+	}
+}
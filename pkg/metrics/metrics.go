@@ -0,0 +1,260 @@
+package metrics
+
+/*
+   metrics writes a file in the Prometheus text format for the
+   node_exporter textfile collector. CNI-plugins are short-lived, so
+   counters and histograms are accumulated in a state file next to
+   the metrics file. Updates are done under flock(2) and the files are
+   replaced atomically, so a scrape never sees a partial file.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Metric types
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Desc Describes a metric
+type Desc struct {
+	Name string
+	Type string
+	Help string
+}
+
+// File A metrics file, should be named "*.prom" in the node_exporter
+// textfile directory. The state is stored in "<Path>.state" and
+// "<Path>.lock" is used for locking
+type File struct {
+	Path  string
+	Descs []Desc
+}
+
+// Hist A histogram with non-cumulative bucket counts
+type Hist struct {
+	Buckets []float64 `json:"buckets"` // Upper bounds, +Inf is implicit
+	Counts  []uint64  `json:"counts"`  // One more than Buckets
+	Sum     float64   `json:"sum"`
+	Count   uint64    `json:"count"`
+}
+
+// State The metric values. Series are keyed by the name and labels in
+// the text format, e.g. `kube_node_invocations_total{command="ADD"}`
+type State struct {
+	Counters   map[string]float64 `json:"counters,omitempty"`
+	Gauges     map[string]float64 `json:"gauges,omitempty"`
+	Histograms map[string]*Hist   `json:"histograms,omitempty"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Key Returns a series key. Labels are given as name/value pairs
+func Key(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	items := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		items = append(items, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+	}
+	return name + "{" + strings.Join(items, ",") + "}"
+}
+
+// splitKey Returns the name and labels (without braces) of a key
+func splitKey(key string) (string, string) {
+	name, labels, _ := strings.Cut(key, "{")
+	return name, strings.TrimSuffix(labels, "}")
+}
+
+// Add Adds to a counter
+func (s *State) Add(key string, v float64) {
+	if s.Counters == nil {
+		s.Counters = make(map[string]float64)
+	}
+	s.Counters[key] += v
+}
+
+// Set Sets a gauge
+func (s *State) Set(key string, v float64) {
+	if s.Gauges == nil {
+		s.Gauges = make(map[string]float64)
+	}
+	s.Gauges[key] = v
+}
+
+// DeleteGauges Deletes gauges with the key as prefix, e.g. all ranges
+// for a network
+func (s *State) DeleteGauges(prefix string) {
+	prefix = strings.TrimSuffix(prefix, "}")
+	for k := range s.Gauges {
+		if strings.HasPrefix(k, prefix) {
+			delete(s.Gauges, k)
+		}
+	}
+}
+
+// Observe Adds an observation to a histogram. The buckets are used
+// if the histogram is new or the buckets have changed
+func (s *State) Observe(key string, buckets []float64, v float64) {
+	if s.Histograms == nil {
+		s.Histograms = make(map[string]*Hist)
+	}
+	h := s.Histograms[key]
+	if h == nil || !equal(h.Buckets, buckets) || len(h.Counts) != len(buckets)+1 {
+		h = &Hist{Buckets: buckets, Counts: make([]uint64, len(buckets)+1)}
+		s.Histograms[key] = h
+	}
+	i := sort.SearchFloat64s(buckets, v)
+	h.Counts[i]++
+	h.Sum += v
+	h.Count++
+}
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Update Reads the state, calls fn and writes the state and the
+// metrics file
+func (f *File) Update(fn func(s *State)) error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(f.Path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close() // Releases the lock
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	var s State
+	if data, err := os.ReadFile(f.Path + ".state"); err == nil {
+		// A corrupt state resets the counters, which Prometheus handles
+		_ = json.Unmarshal(data, &s)
+	}
+	fn(&s)
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(f.Path+".state", data); err != nil {
+		return err
+	}
+	return writeFile(f.Path, f.format(&s))
+}
+
+// writeFile Writes a temporary file and renames it
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// format Returns the state in the Prometheus text format
+func (f *File) format(s *State) []byte {
+	series := make(map[string][]string) // name -> keys
+	for _, m := range []map[string]float64{s.Counters, s.Gauges} {
+		for k := range m {
+			name, _ := splitKey(k)
+			series[name] = append(series[name], k)
+		}
+	}
+	for k := range s.Histograms {
+		name, _ := splitKey(k)
+		series[name] = append(series[name], k)
+	}
+	names := make([]string, 0, len(series))
+	for name := range series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	descs := make(map[string]Desc)
+	for _, d := range f.Descs {
+		descs[d.Name] = d
+	}
+
+	var b bytes.Buffer
+	for _, name := range names {
+		if d, ok := descs[name]; ok {
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, d.Help, name, d.Type)
+		}
+		keys := series[name]
+		sort.Strings(keys)
+		for _, k := range keys {
+			if v, ok := s.Counters[k]; ok {
+				fmt.Fprintf(&b, "%s %s\n", k, formatFloat(v))
+			} else if v, ok := s.Gauges[k]; ok {
+				fmt.Fprintf(&b, "%s %s\n", k, formatFloat(v))
+			} else if h, ok := s.Histograms[k]; ok {
+				formatHist(&b, k, h)
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+func formatHist(b *bytes.Buffer, key string, h *Hist) {
+	name, labels := splitKey(key)
+	if labels != "" {
+		labels += ","
+	}
+	var n uint64
+	for i, c := range h.Counts {
+		n += c
+		le := math.Inf(1)
+		if i < len(h.Buckets) {
+			le = h.Buckets[i]
+		}
+		fmt.Fprintf(b, "%s_bucket{%sle=\"%s\"} %d\n", name, labels, formatFloat(le), n)
+	}
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, suffix, formatFloat(h.Sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, suffix, h.Count)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "textfile", "kube-node.prom")
+	f := &File{Path: path, Descs: []Desc{
+		{Name: "test_total", Type: Counter, Help: "Test counter"},
+		{Name: "test_seconds", Type: Histogram, Help: "Test histogram"},
+	}}
+	buckets := []float64{0.1, 1}
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// A File per updater simulates separate processes
+			f := &File{Path: f.Path, Descs: f.Descs}
+			err := f.Update(func(s *State) {
+				s.Add(Key("test_total", "network", "net1", "code", "0"), 1)
+				s.Observe(Key("test_seconds", "op", "get"), buckets, 0.5)
+			})
+			if err != nil {
+				t.Error("Update:", err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := f.Update(func(s *State) {
+		s.Set(Key("test_addresses", "network", "net1", "range", "10.0.0.0/24"), 3)
+		s.Set(Key("test_addresses", "network", "net2", "range", "10.0.1.0/24"), 4)
+		s.DeleteGauges(Key("test_addresses", "network", "net1"))
+		s.Set(Key("test_addresses", "network", "net1", "range", "10.0.2.0/24"), 5)
+		s.Set(Key("test_escape", "v", "a\"b\\c\nd"), 1)
+	})
+	if err != nil {
+		t.Fatal("Update:", err)
+	}
+	data, _ := os.ReadFile(path)
+	expect := []string{
+		"# HELP test_total Test counter\n# TYPE test_total counter\n",
+		`test_total{network="net1",code="0"} 50` + "\n",
+		`test_seconds_bucket{op="get",le="0.1"} 0` + "\n",
+		`test_seconds_bucket{op="get",le="1"} 50` + "\n",
+		`test_seconds_bucket{op="get",le="+Inf"} 50` + "\n",
+		`test_seconds_sum{op="get"} 25` + "\n",
+		`test_seconds_count{op="get"} 50` + "\n",
+		`test_addresses{network="net1",range="10.0.2.0/24"} 5` + "\n",
+		`test_addresses{network="net2",range="10.0.1.0/24"} 4` + "\n",
+		`test_escape{v="a\"b\\c\nd"} 1` + "\n",
+	}
+	for _, e := range expect {
+		if !strings.Contains(string(data), e) {
+			t.Fatalf("Expected %q in:\n%s", e, data)
+		}
+	}
+	if strings.Contains(string(data), "10.0.0.0/24") {
+		t.Fatalf("Gauge not deleted:\n%s", data)
+	}
+	// No temporary files are left
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(path), ".*"))
+	if len(files) != 0 {
+		t.Fatal("Temporary files left", files)
+	}
+}
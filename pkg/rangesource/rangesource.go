@@ -0,0 +1,301 @@
+package rangesource
+
+/*
+   rangesource defines sources for address ranges (subnets) used by
+   kube-node. A source may for instance read spec.podCIDRs or an
+   annotation from the own K8s node object, or read a local file.
+
+   Sources can be combined in a Chain where they are tried in order
+   until one succeeds.
+*/
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	"github.com/go-logr/logr"
+	k8s "k8s.io/api/core/v1"
+)
+
+// RangeSource A source of address ranges (subnets) in CIDR format
+type RangeSource interface {
+	// Name Returns the name of the source as used in the config
+	Name() string
+	// GetRanges Returns the ranges. An error is returned if the source
+	// can't provide any ranges
+	GetRanges(ctx context.Context) ([]string, error)
+}
+
+// Config Parameters used when sources are created by name
+type Config struct {
+	Annotation string   // Used by "annotation"
+	File       string   // Used by "file", DefaultFile if empty
+	Network    string   // Used by "file"
+	Ranges     []string // Used by "static"
+	Node       *OwnNode // Used by "podCIDRs" and "annotation"
+}
+
+// Source names
+const (
+	PodCIDRs   = "podCIDRs"
+	Annotation = "annotation"
+	File       = "file"
+	Static     = "static"
+)
+
+// New Returns a RangeSource with the passed name
+func New(name string, cfg *Config) (RangeSource, error) {
+	switch name {
+	case PodCIDRs:
+		if cfg.Node == nil {
+			return nil, fmt.Errorf("No node reader")
+		}
+		return &podCIDRsSource{node: cfg.Node}, nil
+	case Annotation:
+		if cfg.Node == nil {
+			return nil, fmt.Errorf("No node reader")
+		}
+		if cfg.Annotation == "" {
+			return nil, fmt.Errorf("No annotation specified")
+		}
+		return &annotationSource{node: cfg.Node, key: cfg.Annotation}, nil
+	case File:
+		path := cfg.File
+		if path == "" {
+			path = DefaultFile
+		}
+		return &fileSource{
+			path: path, network: cfg.Network, machineID: util.MachineID}, nil
+	case Static:
+		if len(cfg.Ranges) == 0 {
+			return nil, fmt.Errorf("No static ranges specified")
+		}
+		return &staticSource{ranges: cfg.Ranges}, nil
+	}
+	return nil, fmt.Errorf("Unknown range source [%s]", name)
+}
+
+// Chain A RangeSource that tries a list of sources in order
+type Chain struct {
+	sources []RangeSource
+}
+
+// NewChain Returns a Chain with sources created by name
+func NewChain(names []string, cfg *Config) (*Chain, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No range sources")
+	}
+	c := Chain{}
+	for _, name := range names {
+		s, err := New(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.sources = append(c.sources, s)
+	}
+	return &c, nil
+}
+
+// Name Returns the source names separated by comma
+func (c *Chain) Name() string {
+	names := make([]string, len(c.sources))
+	for i, s := range c.sources {
+		names[i] = s.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// GetRanges Returns the ranges from the first source that succeeds.
+// If all sources fail, the errors are combined
+func (c *Chain) GetRanges(ctx context.Context) ([]string, error) {
+	logger := logr.FromContextOrDiscard(ctx)
+	var errs []string
+	for _, s := range c.sources {
+		cidrs, err := s.GetRanges(ctx)
+		if err == nil {
+			logger.V(2).Info("Ranges read", "source", s.Name(), "ranges", cidrs)
+			return cidrs, nil
+		}
+		logger.V(1).Error(err, "Range source failed", "source", s.Name())
+		errs = append(errs, fmt.Sprintf("%s: %v", s.Name(), err))
+	}
+	return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+}
+
+// ParseCIDRs Splits a comma separated string and checks that all
+// items are valid CIDRs
+func ParseCIDRs(s string) ([]string, error) {
+	cidrs := strings.Split(s, ",")
+	for _, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, err
+		}
+	}
+	return cidrs, nil
+}
+
+// OwnNode Reads the own K8s node object. The object is read once and
+// shared by all sources that needs it
+type OwnNode struct {
+	reader util.NodeReader
+	node   *k8s.Node
+	err    error
+	done   bool
+}
+
+// NewOwnNode Returns an OwnNode using the passed reader
+func NewOwnNode(reader util.NodeReader) *OwnNode {
+	return &OwnNode{reader: reader}
+}
+
+// Get Returns the own node object
+func (o *OwnNode) Get(ctx context.Context) (*k8s.Node, error) {
+	if !o.done {
+		o.node, o.err = getOwnNode(ctx, o.reader)
+		o.done = true
+	}
+	return o.node, o.err
+}
+
+// Peek Returns the own node object if it has been read, or nil
+func (o *OwnNode) Peek() *k8s.Node {
+	return o.node
+}
+
+func getOwnNode(ctx context.Context, nodeReader util.NodeReader) (*k8s.Node, error) {
+	// If the NODE_NAME environment variable is specified it's assumed
+	// to be correct
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		n, err := nodeReader.GetNode(ctx, nodeName)
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+
+	nodes, err := nodeReader.GetNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n := util.FindOwnNode(ctx, nodes); n != nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("Own node object not found")
+}
+
+// podCIDRsSource Takes ranges from spec.podCIDRs in the own node object
+type podCIDRsSource struct {
+	node *OwnNode
+}
+
+func (s *podCIDRsSource) Name() string {
+	return PodCIDRs
+}
+func (s *podCIDRsSource) GetRanges(ctx context.Context) ([]string, error) {
+	n, err := s.node.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n.Spec.PodCIDRs == nil {
+		return nil, fmt.Errorf("No spec.podCIDRs found")
+	}
+	return n.Spec.PodCIDRs, nil
+}
+
+// annotationSource Takes ranges from an annotation in the own node object
+type annotationSource struct {
+	node *OwnNode
+	key  string
+}
+
+func (s *annotationSource) Name() string {
+	return Annotation
+}
+func (s *annotationSource) GetRanges(ctx context.Context) ([]string, error) {
+	n, err := s.node.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := n.ObjectMeta.Annotations[s.key]; ok {
+		return ParseCIDRs(c)
+	}
+	return nil, fmt.Errorf("Annotation not found")
+}
+
+// DefaultFile The file used by the "file" source if no file is specified
+const DefaultFile = "/etc/cni/kube-node/ranges.json"
+
+// fileSource Takes ranges from a local json file, written by
+// provisioning tools. The file contains an object with network names
+// as keys and lists of CIDRs as values. Ranges for a specific node may
+// be specified in an object with the machine-id as key. These takes
+// precedence over the common ones. Example:
+//
+//	{
+//	  "net1": ["172.20.2.0/24", "fd00::2:0:0/96"],
+//	  "3b6c8e2a0f5d4e9c8a7b6c5d4e3f2a1b": {
+//	    "net1": ["172.20.3.0/24", "fd00::3:0:0/96"]
+//	  }
+//	}
+type fileSource struct {
+	path      string
+	network   string
+	machineID func() (string, error)
+}
+
+func (s *fileSource) Name() string {
+	return File
+}
+func (s *fileSource) GetRanges(ctx context.Context) ([]string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	// Node specific ranges first
+	if id, err := s.machineID(); err == nil {
+		if raw, ok := entries[id]; ok {
+			var networks map[string][]string
+			if err := json.Unmarshal(raw, &networks); err != nil {
+				return nil, fmt.Errorf("Invalid entry [%s] %v", id, err)
+			}
+			if cidrs, ok := networks[s.network]; ok && len(cidrs) > 0 {
+				return ParseCIDRs(strings.Join(cidrs, ","))
+			}
+		}
+	} else {
+		logr.FromContextOrDiscard(ctx).V(1).Error(err, "Read machine-id")
+	}
+
+	if raw, ok := entries[s.network]; ok {
+		var cidrs []string
+		if err := json.Unmarshal(raw, &cidrs); err != nil {
+			return nil, fmt.Errorf("Invalid entry [%s] %v", s.network, err)
+		}
+		if len(cidrs) > 0 {
+			return ParseCIDRs(strings.Join(cidrs, ","))
+		}
+	}
+	return nil, fmt.Errorf("Network not found [%s]", s.network)
+}
+
+// staticSource Returns ranges specified in the config
+type staticSource struct {
+	ranges []string
+}
+
+func (s *staticSource) Name() string {
+	return Static
+}
+func (s *staticSource) GetRanges(ctx context.Context) ([]string, error) {
+	return ParseCIDRs(strings.Join(s.ranges, ","))
+}
@@ -0,0 +1,179 @@
+package rangesource
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nordix/ipam-node-annotation/pkg/util"
+	k8s "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeNodeReader Returns one node regardless of name
+type fakeNodeReader struct {
+	node *k8s.Node
+}
+
+func (r *fakeNodeReader) GetNodes(ctx context.Context) ([]k8s.Node, error) {
+	if r.node == nil {
+		return nil, fmt.Errorf("No nodes")
+	}
+	return []k8s.Node{*r.node}, nil
+}
+func (r *fakeNodeReader) GetNode(ctx context.Context, name string) (*k8s.Node, error) {
+	if r.node == nil {
+		return nil, fmt.Errorf("Node not found")
+	}
+	return r.node, nil
+}
+
+func testNode() *k8s.Node {
+	return &k8s.Node{
+		ObjectMeta: meta.ObjectMeta{
+			Name: "vm-002",
+			Annotations: map[string]string{
+				"kube-node.nordix.org/net1": "172.20.2.0/24,fd00::2:0:0/96",
+				"kube-node.nordix.org/bad":  "172.20.2.0/24,blah",
+			},
+		},
+		Spec: k8s.NodeSpec{
+			PodCIDRs: []string{"11.0.1.0/24", "1100:0:0:1::/64"},
+		},
+	}
+}
+
+func TestRangeSources(t *testing.T) {
+	os.Setenv("NODE_NAME", "vm-002")
+	defer os.Unsetenv("NODE_NAME")
+	dir := t.TempDir()
+	util.MachineIDFile = filepath.Join(dir, "machine-id")
+	err := os.WriteFile(util.MachineIDFile, []byte("\nmachine1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rfile := filepath.Join(dir, "ranges.json")
+	err = os.WriteFile(rfile, []byte(`{
+  "net2": ["10.10.0.0/24", "fd00::10:0/120"],
+  "net3": ["10.30.0.0/24"],
+  "net4": "10.40.0.0/24",
+  "machine1": { "net3": ["10.31.0.0/24"] },
+  "machine2": { "net2": ["10.20.0.0/24"] }
+}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcases := []struct {
+		name        string
+		sources     []string
+		cfg         Config
+		node        *k8s.Node
+		expect      []string
+		expectError bool
+	}{
+		{
+			name:    "podCIDRs",
+			sources: []string{PodCIDRs},
+			node:    testNode(),
+			expect:  []string{"11.0.1.0/24", "1100:0:0:1::/64"},
+		},
+		{
+			name:    "Annotation",
+			sources: []string{Annotation},
+			cfg:     Config{Annotation: "kube-node.nordix.org/net1"},
+			node:    testNode(),
+			expect:  []string{"172.20.2.0/24", "fd00::2:0:0/96"},
+		},
+		{
+			name:        "Annotation not found",
+			sources:     []string{Annotation},
+			cfg:         Config{Annotation: "kube-node.nordix.org/net2"},
+			node:        testNode(),
+			expectError: true,
+		},
+		{
+			name:        "Invalid annotation",
+			sources:     []string{Annotation},
+			cfg:         Config{Annotation: "kube-node.nordix.org/bad"},
+			node:        testNode(),
+			expectError: true,
+		},
+		{
+			name:    "Fallback to podCIDRs",
+			sources: []string{Annotation, PodCIDRs},
+			cfg:     Config{Annotation: "kube-node.nordix.org/net2"},
+			node:    testNode(),
+			expect:  []string{"11.0.1.0/24", "1100:0:0:1::/64"},
+		},
+		{
+			name:    "Fallback to file",
+			sources: []string{Annotation, File},
+			cfg: Config{
+				Annotation: "kube-node.nordix.org/net1",
+				File:       rfile,
+				Network:    "net2",
+			},
+			expect: []string{"10.10.0.0/24", "fd00::10:0/120"},
+		},
+		{
+			name:        "File network not found",
+			sources:     []string{File},
+			cfg:         Config{File: rfile, Network: "net1"},
+			expectError: true,
+		},
+		{
+			name:    "File machine-id",
+			sources: []string{File},
+			cfg:     Config{File: rfile, Network: "net3"},
+			expect:  []string{"10.31.0.0/24"},
+		},
+		{
+			name:        "File invalid entry",
+			sources:     []string{File},
+			cfg:         Config{File: rfile, Network: "net4"},
+			expectError: true,
+		},
+		{
+			name:        "File missing",
+			sources:     []string{File},
+			cfg:         Config{File: filepath.Join(dir, "nothere.json")},
+			expectError: true,
+		},
+		{
+			name:    "Static",
+			sources: []string{Static},
+			cfg:     Config{Ranges: []string{"10.0.0.0/24"}},
+			expect:  []string{"10.0.0.0/24"},
+		},
+		{
+			name:        "Unknown source",
+			sources:     []string{"dhcp"},
+			expectError: true,
+		},
+		{
+			name:        "No sources",
+			expectError: true,
+		},
+	}
+	for _, tc := range tcases {
+		tc.cfg.Node = NewOwnNode(&fakeNodeReader{node: tc.node})
+		var cidrs []string
+		c, err := NewChain(tc.sources, &tc.cfg)
+		if err == nil {
+			cidrs, err = c.GetRanges(context.TODO())
+		}
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.name, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.name)
+		}
+		if fmt.Sprint(cidrs) != fmt.Sprint(tc.expect) {
+			t.Fatalf("%s: Expected %v, got %v\n", tc.name, tc.expect, cidrs)
+		}
+		t.Logf("%s: err %v\n", tc.name, err)
+	}
+}
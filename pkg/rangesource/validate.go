@@ -0,0 +1,43 @@
+package rangesource
+
+import (
+	"fmt"
+	"net"
+)
+
+// Validate Checks that one or two valid subnets are specified. If 2
+// subnets are specified they must be of different families
+func Validate(cidrs []string) error {
+	if len(cidrs) == 0 {
+		return fmt.Errorf("No Ranges")
+	}
+	if len(cidrs) > 2 {
+		return fmt.Errorf("Too many Ranges")
+	}
+	isIPv4 := make([]bool, 0, 2)
+	for _, cidr := range cidrs {
+		if ip, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("Invalid subnet %v", err)
+		} else {
+			isIPv4 = append(isIPv4, ip.To4() != nil)
+		}
+	}
+	if len(isIPv4) == 2 && isIPv4[0] == isIPv4[1] {
+		return fmt.Errorf("Subnets of same family")
+	}
+	return nil
+}
+
+// Overlap Returns true if the two subnets overlap. Invalid subnets
+// never overlap
+func Overlap(a, b string) bool {
+	_, na, err := net.ParseCIDR(a)
+	if err != nil {
+		return false
+	}
+	_, nb, err := net.ParseCIDR(b)
+	if err != nil {
+		return false
+	}
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
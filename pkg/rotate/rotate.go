@@ -0,0 +1,150 @@
+package rotate
+
+/*
+   rotate implements a file that is rotated when it exceeds a max
+   size or age. CNI-plugins are short-lived processes that may run
+   concurrently, so the file is opened and locked with flock(2) on
+   each write.
+
+   The age is counted from the birth time of the file, if the file
+   system provides it, so it is the same for all processes. Otherwise
+   it is counted from when the file was first opened by the process.
+*/
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// File A size and age rotated file. Backups are named <path>.1
+// (newest) to <path>.<MaxBackups>
+type File struct {
+	Path       string
+	MaxSize    int64 // In bytes. No rotation if <= 0
+	MaxBackups int   // At least one backup is kept
+	// MaxAge The file is rotated when it is older than this, and
+	// older backups are removed on rotation. No limit if 0
+	MaxAge time.Duration
+	mu     sync.Mutex
+	ino    uint64    // The file opened at "opened"
+	opened time.Time // Birth time, or first open by this File
+}
+
+// New Returns a File with sizes in MiB
+func New(path string, maxSizeMB, maxBackups int) *File {
+	return &File{
+		Path:       path,
+		MaxSize:    int64(maxSizeMB) * 1024 * 1024,
+		MaxBackups: maxBackups,
+	}
+}
+
+// Write Appends p to the file, rotating it first if it would exceed
+// MaxSize. A single write is never split between files
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for {
+		file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return 0, err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return 0, err
+		}
+		// Another process may have rotated the file while we waited
+		// for the lock
+		if !f.same(file) {
+			file.Close()
+			continue
+		}
+		st, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		f.track(file, st)
+		if st.Size() > 0 && (f.tooLarge(st.Size()+int64(len(p))) || f.tooOld()) {
+			err := f.rotate()
+			file.Close() // Releases the lock
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n, err := file.Write(p)
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		return n, err
+	}
+}
+
+// track Records when the open file was created, or first opened if
+// the birth time is unknown
+func (f *File) track(file *os.File, st os.FileInfo) {
+	sys, ok := st.Sys().(*syscall.Stat_t)
+	if !ok || sys.Ino == f.ino {
+		return
+	}
+	f.ino = sys.Ino
+	f.opened = time.Now()
+	var sx unix.Statx_t
+	err := unix.Statx(int(file.Fd()), "", unix.AT_EMPTY_PATH, unix.STATX_BTIME, &sx)
+	if err == nil && sx.Mask&unix.STATX_BTIME != 0 {
+		f.opened = time.Unix(sx.Btime.Sec, int64(sx.Btime.Nsec))
+	}
+}
+
+func (f *File) tooLarge(size int64) bool {
+	return f.MaxSize > 0 && size > f.MaxSize
+}
+
+func (f *File) tooOld() bool {
+	return f.MaxAge > 0 && !f.opened.IsZero() && time.Since(f.opened) > f.MaxAge
+}
+
+// same Returns true if the open file is the one at Path
+func (f *File) same(file *os.File) bool {
+	st1, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	st2, err := os.Stat(f.Path)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(st1, st2)
+}
+
+// rotate Renames the backups and the file. Must be called with the lock held
+func (f *File) rotate() error {
+	n := f.MaxBackups
+	if n < 1 {
+		n = 1
+	}
+	for i := n - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", f.Path, i)
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", f.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(f.Path, f.Path+".1"); err != nil {
+		return err
+	}
+	if f.MaxAge > 0 {
+		for i := 2; i <= n; i++ {
+			name := fmt.Sprintf("%s.%d", f.Path, i)
+			if st, err := os.Stat(name); err == nil && time.Since(st.ModTime()) > f.MaxAge {
+				_ = os.Remove(name)
+			}
+		}
+	}
+	return nil
+}
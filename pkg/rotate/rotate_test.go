@@ -0,0 +1,112 @@
+package rotate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f := &File{Path: path, MaxSize: 100, MaxBackups: 2}
+	line := strings.Repeat("x", 39) + "\n" // 40 bytes
+	for i := 0; i < 7; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal("Write:", err)
+		}
+	}
+	// 2+2+2+1 lines, the oldest file is dropped
+	for name, size := range map[string]int64{"": 40, ".1": 80, ".2": 80} {
+		st, err := os.Stat(path + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() != size {
+			t.Fatalf("%s: expected size %d, got %d", path+name, size, st.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("Too many backups")
+	}
+
+	// A write larger than MaxSize is not split
+	if _, err := f.Write([]byte(strings.Repeat("y", 200))); err != nil {
+		t.Fatal("Write:", err)
+	}
+	if st, _ := os.Stat(path); st.Size() != 200 {
+		t.Fatal("Unexpected size", st.Size())
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f := &File{Path: path, MaxSize: 10, MaxBackups: 5, MaxAge: time.Hour}
+	for i := 0; i < 3; i++ {
+		_, _ = f.Write([]byte("0123456789"))
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	_ = os.Chtimes(path+".2", old, old)
+	_, _ = f.Write([]byte("0123456789"))
+	// .2 became .3 and is removed
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("Old backup not removed")
+	}
+	if _, err := os.Stat(path + ".2"); err != nil {
+		t.Fatal("Backup removed", err)
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	f := &File{Path: path, MaxBackups: 2, MaxAge: time.Hour}
+	_, _ = f.Write([]byte("old\n"))
+	_, _ = f.Write([]byte("old\n"))
+	if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+		t.Fatal("Rotated before MaxAge")
+	}
+	f.opened = time.Now().Add(-2 * time.Hour)
+	_, _ = f.Write([]byte("new\n"))
+	if data, _ := os.ReadFile(path + ".1"); string(data) != "old\nold\n" {
+		t.Fatalf("Backup: %q", data)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Fatalf("File: %q", data)
+	}
+	// The new file is tracked from its creation
+	_, _ = f.Write([]byte("new\n"))
+	if data, _ := os.ReadFile(path); string(data) != "new\nnew\n" {
+		t.Fatalf("File after rotation: %q", data)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	const n = 200
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// A File per writer simulates separate processes
+			f := &File{Path: path, MaxSize: 1000, MaxBackups: 100}
+			_, _ = f.Write([]byte(fmt.Sprintf("%09d\n", i)))
+		}(i)
+	}
+	wg.Wait()
+	files, _ := filepath.Glob(path + "*")
+	lines := 0
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if len(data) > 1000 {
+			t.Fatalf("%s: size %d", file, len(data))
+		}
+		lines += strings.Count(string(data), "\n")
+	}
+	if lines != n {
+		t.Fatalf("Expected %d lines, got %d", n, lines)
+	}
+}
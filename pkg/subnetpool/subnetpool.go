@@ -0,0 +1,129 @@
+package subnetpool
+
+/*
+   subnetpool allocates subnets of a fixed prefix length from a larger
+   CIDR. It is used to hand out per-node subnets from a cluster-wide
+   pool. The lowest free subnet is always allocated.
+*/
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+)
+
+// Pool A pool of subnets for one address family
+type Pool struct {
+	base   *net.IPNet
+	prefix int      // Prefix length of allocated subnets
+	bits   int      // 32 or 128
+	count  *big.Int // Number of subnets in the pool
+	used   map[string]bool
+}
+
+// New Returns a pool of subnets with the passed prefix length carved
+// out of cidr
+func New(cidr string, prefix int) (*Pool, error) {
+	_, base, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ones, bits := base.Mask.Size()
+	if prefix < ones || prefix > bits {
+		return nil, fmt.Errorf("Invalid prefix /%d for %s", prefix, cidr)
+	}
+	return &Pool{
+		base:   base,
+		prefix: prefix,
+		bits:   bits,
+		count:  new(big.Int).Lsh(big.NewInt(1), uint(prefix-ones)),
+		used:   make(map[string]bool),
+	}, nil
+}
+
+// IsIPv4 Returns true if this is an IPv4 pool
+func (p *Pool) IsIPv4() bool {
+	return p.bits == 32
+}
+
+// String Returns the pool in "cidr/prefix" form, e.g. "10.0.0.0/16/24"
+func (p *Pool) String() string {
+	return fmt.Sprintf("%s/%d", p.base.String(), p.prefix)
+}
+
+// Allocate Allocates the lowest free subnet
+func (p *Pool) Allocate() (string, error) {
+	one := big.NewInt(1)
+	for i := big.NewInt(0); i.Cmp(p.count) < 0; i.Add(i, one) {
+		subnet := p.subnet(i)
+		if !p.used[subnet] {
+			p.used[subnet] = true
+			return subnet, nil
+		}
+	}
+	return "", fmt.Errorf("Pool exhausted %s", p.String())
+}
+
+// Claim Marks a subnet as used. The subnet must be a free subnet in
+// the pool with the pool prefix length
+func (p *Pool) Claim(subnet string) error {
+	s, err := p.normalize(subnet)
+	if err != nil {
+		return err
+	}
+	if p.used[s] {
+		return fmt.Errorf("Subnet already allocated %s", s)
+	}
+	p.used[s] = true
+	return nil
+}
+
+// Release Returns a subnet to the pool
+func (p *Pool) Release(subnet string) {
+	if s, err := p.normalize(subnet); err == nil {
+		delete(p.used, s)
+	}
+}
+
+// Contains Returns true if the subnet belongs to the pool
+func (p *Pool) Contains(subnet string) bool {
+	_, err := p.normalize(subnet)
+	return err == nil
+}
+
+// Used Returns the number of allocated subnets
+func (p *Pool) Used() int {
+	return len(p.used)
+}
+
+// normalize Checks that the subnet belongs to the pool and returns it
+// in canonical form
+func (p *Pool) normalize(subnet string) (string, error) {
+	ip, n, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return "", err
+	}
+	ones, bits := n.Mask.Size()
+	if bits != p.bits || ones != p.prefix {
+		return "", fmt.Errorf("Subnet %s doesn't match pool %s", subnet, p.String())
+	}
+	if !ip.Equal(n.IP) || !p.base.Contains(n.IP) {
+		return "", fmt.Errorf("Subnet %s not in pool %s", subnet, p.String())
+	}
+	return n.String(), nil
+}
+
+// subnet Returns subnet number i in the pool
+func (p *Pool) subnet(i *big.Int) string {
+	base := p.base.IP.To16()
+	if p.IsIPv4() {
+		base = p.base.IP.To4()
+	}
+	offset := new(big.Int).Lsh(i, uint(p.bits-p.prefix))
+	addr := new(big.Int).SetBytes(base)
+	addr.Add(addr, offset)
+	ip := make(net.IP, len(base))
+	addr.FillBytes(ip)
+	n := net.IPNet{IP: ip, Mask: net.CIDRMask(p.prefix, p.bits)}
+	return n.String()
+}
@@ -0,0 +1,104 @@
+package subnetpool
+
+import (
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tcases := []struct {
+		cidr        string
+		prefix      int
+		expectError bool
+	}{
+		{cidr: "172.20.0.0/16", prefix: 24},
+		{cidr: "fd00::/64", prefix: 96},
+		{cidr: "172.20.0.0/16", prefix: 16},
+		{cidr: "172.20.0.0/16", prefix: 8, expectError: true},
+		{cidr: "172.20.0.0/16", prefix: 33, expectError: true},
+		{cidr: "blah", prefix: 24, expectError: true},
+	}
+	for _, tc := range tcases {
+		_, err := New(tc.cidr, tc.prefix)
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s/%d: unexpected error %v\n", tc.cidr, tc.prefix, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s/%d: Expected error but got OK\n", tc.cidr, tc.prefix)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	p, err := New("172.20.0.0/22", 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Claim("172.20.1.0/24"); err != nil {
+		t.Fatal("Claim:", err)
+	}
+	expect := []string{"172.20.0.0/24", "172.20.2.0/24", "172.20.3.0/24"}
+	for _, e := range expect {
+		s, err := p.Allocate()
+		if err != nil {
+			t.Fatal("Allocate:", err)
+		}
+		if s != e {
+			t.Fatalf("Expected %s, got %s", e, s)
+		}
+	}
+	if _, err := p.Allocate(); err == nil {
+		t.Fatal("Expected pool exhausted")
+	}
+	p.Release("172.20.2.0/24")
+	if s, _ := p.Allocate(); s != "172.20.2.0/24" {
+		t.Fatalf("Expected 172.20.2.0/24 after release, got %s", s)
+	}
+	if p.Used() != 4 {
+		t.Fatalf("Expected 4 used, got %d", p.Used())
+	}
+}
+
+func TestAllocateIPv6(t *testing.T) {
+	p, err := New("fd00::/64", 96)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.IsIPv4() {
+		t.Fatal("Expected IPv6 pool")
+	}
+	_, _ = p.Allocate()
+	s, err := p.Allocate()
+	if err != nil {
+		t.Fatal("Allocate:", err)
+	}
+	if s != "fd00::1:0:0/96" {
+		t.Fatalf("Expected fd00::1:0:0/96, got %s", s)
+	}
+}
+
+func TestClaim(t *testing.T) {
+	p, err := New("172.20.0.0/16", 24)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcases := []struct {
+		subnet      string
+		expectError bool
+	}{
+		{subnet: "172.20.7.0/24"},
+		{subnet: "172.20.7.0/24", expectError: true}, // Already used
+		{subnet: "172.20.8.1/24", expectError: true}, // Not aligned
+		{subnet: "172.20.9.0/25", expectError: true}, // Wrong prefix
+		{subnet: "172.21.0.0/24", expectError: true}, // Outside
+		{subnet: "fd00::/24", expectError: true},     // Wrong family
+	}
+	for _, tc := range tcases {
+		err := p.Claim(tc.subnet)
+		if err != nil && !tc.expectError {
+			t.Fatalf("%s: unexpected error %v\n", tc.subnet, err)
+		}
+		if err == nil && tc.expectError {
+			t.Fatalf("%s: Expected error but got OK\n", tc.subnet)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Invocation Identifies a CNI invocation. The fields are added to
+// all log lines and to the details in CNI errors, so log lines from
+// parallel invocations can be told apart
+type Invocation struct {
+	ID           string // Short random ID
+	Command      string
+	ContainerID  string
+	IfName       string
+	Network      string
+	PodNamespace string
+	PodName      string
+}
+
+type invocationKey struct{}
+
+// NewInvocation Returns an Invocation for the current CNI command
+func NewInvocation(network string) *Invocation {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	return &Invocation{
+		ID:           hex.EncodeToString(id),
+		Command:      os.Getenv("CNI_COMMAND"),
+		ContainerID:  os.Getenv("CNI_CONTAINERID"),
+		IfName:       os.Getenv("CNI_IFNAME"),
+		Network:      network,
+		PodNamespace: CniArg("K8S_POD_NAMESPACE"),
+		PodName:      CniArg("K8S_POD_NAME"),
+	}
+}
+
+// KeysAndValues Returns the fields for logr.Logger.WithValues
+func (i *Invocation) KeysAndValues() []any {
+	return []any{
+		"invocation", i.ID,
+		"command", i.Command,
+		"containerID", i.ContainerID,
+		"ifname", i.IfName,
+		"network", i.Network,
+		"podNamespace", i.PodNamespace,
+		"podName", i.PodName,
+	}
+}
+
+// String Returns the fields as "key=value" pairs
+func (i *Invocation) String() string {
+	kv := i.KeysAndValues()
+	items := make([]string, 0, len(kv)/2)
+	for n := 0; n < len(kv); n += 2 {
+		if v := kv[n+1].(string); v != "" {
+			items = append(items, fmt.Sprintf("%s=%s", kv[n], v))
+		}
+	}
+	return strings.Join(items, " ")
+}
+
+// WithInvocation Returns a context holding the invocation
+func WithInvocation(ctx context.Context, i *Invocation) context.Context {
+	return context.WithValue(ctx, invocationKey{}, i)
+}
+
+// InvocationFrom Returns the invocation in the context, or nil
+func InvocationFrom(ctx context.Context) *Invocation {
+	i, _ := ctx.Value(invocationKey{}).(*Invocation)
+	return i
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"bufio"
+	"strings"
 
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	k8s "k8s.io/api/core/v1"
@@ -48,41 +49,60 @@ func EmitJson(object any) {
 	}
 }
 
+// MachineIDFile The file holding the machine-id of this node
+var MachineIDFile = "/etc/machine-id"
+
+// MachineID Returns the first non-empty line in MachineIDFile
+func MachineID() (string, error) {
+	file, err := os.Open(MachineIDFile)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Find first non-empty line (may be only white-space though...)
+		if machineId := scanner.Text(); machineId != "" {
+			return machineId, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("Empty machine-id")
+}
+
+// BootIDFile The file holding the boot ID, changed on each boot
+var BootIDFile = "/proc/sys/kernel/random/boot_id"
+
+// BootID Returns the boot ID
+func BootID() (string, error) {
+	data, err := os.ReadFile(BootIDFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
 // Find own node.  The own node is found by comparing
 // status.nodeInfo.machineID with the "/etc/machine-id" file. The node
 // name may differ from the hostname and several nodes may have the
 // same hostname so this is the (only?) safe way
 func FindOwnNode(ctx context.Context, nodes []k8s.Node) *k8s.Node {
 	logger := logr.FromContextOrDiscard(ctx)
-	// First try the machine-id
-	file, err := os.Open("/etc/machine-id")
+	machineId, err := MachineID()
 	if err != nil {
-		logger.Error(err, "os.Open", "file", "/etc/machine-id")
+		logger.Error(err, "Read machine-id", "file", MachineIDFile)
 		return nil
 	}
-	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	var machineId string
-	for scanner.Scan() {
-		machineId = scanner.Text()
-		if machineId == "" {
-			// Find first non-empty line (may be only white-space though...)
-			continue
-		}
-		logger.V(2).Info("Read machine-id", "machine-id", machineId)
-		if machineId != "" {
-			for _, n := range nodes {
-				if n.Status.NodeInfo.MachineID == machineId {
-					logger.V(2).Info(
-						"Found own node", "name", n.ObjectMeta.Name)
-					return &n
-				}
-			}
+	logger.V(2).Info("Read machine-id", "machine-id", machineId)
+	for _, n := range nodes {
+		if n.Status.NodeInfo.MachineID == machineId {
+			logger.V(2).Info(
+				"Found own node", "name", n.ObjectMeta.Name)
+			return &n
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		logger.Error(err, "Scanning machine-id")
-	}
 	return nil
 }
 
@@ -141,6 +161,18 @@ func (o *realNodeReader) GetNode(ctx context.Context, name string) (*k8s.Node, e
 	return &nodes.Items[0], nil
 }
 
+// CniArg Returns the value of a key in $CNI_ARGS, or ""
+func CniArg(key string) string {
+	if cniArgs := os.Getenv("CNI_ARGS"); cniArgs != "" {
+		for _, s := range strings.Split(cniArgs, ";") {
+			if v, ok := strings.CutPrefix(s, key+"="); ok {
+				return v
+			}
+		}
+	}
+	return ""
+}
+
 // CniVersion Holds the CNI version. This variable MUST be updated to
 // the CNI version in the request after it has been read from stdin.
 var CniVersion = "0.1.0"
@@ -158,6 +190,9 @@ func CniError(ctx context.Context, err error, code uint, msg string) string {
 		Msg: msg,
 		Details: err.Error(),
 	}
+	if i := InvocationFrom(ctx); i != nil {
+		cnierr.Details += "; " + i.String()
+	}
 	out, err := json.Marshal(cnierr)
 	if err != nil {
 		return fmt.Sprintf(
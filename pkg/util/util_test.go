@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -28,3 +29,27 @@ func TestCniError(t *testing.T) {
 	}
 	//fmt.Println(cniErr)
 }
+
+func TestInvocation(t *testing.T) {
+	os.Setenv("CNI_COMMAND", "ADD")
+	os.Setenv("CNI_CONTAINERID", "c1")
+	os.Setenv("CNI_ARGS", "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=web-0")
+	defer os.Unsetenv("CNI_COMMAND")
+	defer os.Unsetenv("CNI_CONTAINERID")
+	defer os.Unsetenv("CNI_ARGS")
+	inv := NewInvocation("net1")
+	if len(inv.ID) != 8 || inv.PodNamespace != "default" || inv.PodName != "web-0" {
+		t.Fatalf("Unexpected %+v", inv)
+	}
+	ctx := WithInvocation(context.TODO(), inv)
+	var cniErrorData CniErrorData
+	err := json.Unmarshal([]byte(CniError(ctx, fmt.Errorf("Failed"), 7, "Msg")), &cniErrorData)
+	if err != nil {
+		t.Fatal("Unmarshal", err)
+	}
+	expect := "Failed; invocation=" + inv.ID +
+		" command=ADD containerID=c1 network=net1 podNamespace=default podName=web-0"
+	if cniErrorData.Details != expect {
+		t.Fatalf("Unexpected details %q", cniErrorData.Details)
+	}
+}